@@ -0,0 +1,245 @@
+package apply
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"tailscale-route-tiller/config"
+	"tailscale-route-tiller/slack"
+	"tailscale-route-tiller/state"
+	"tailscale-route-tiller/tailscale"
+	"tailscale-route-tiller/utils"
+	"time"
+)
+
+const defaultVerifyTimeout = 30
+const defaultVerifyInterval = 3
+
+// Steps of an apply, as reported in Error
+const (
+	StepSnapshot  = "snapshot"
+	StepAdvertise = "advertise"
+	StepApprove   = "approve"
+	StepVerify    = "verify"
+)
+
+// ErrNotLeader is returned when leadership was lost during an apply
+var ErrNotLeader = errors.New("not the leader, leaving the update to the leader")
+
+// Leading reports whether this instance may still change routes. It is
+// checked before every step, so a worker that lost its lease mid-apply stops
+// there. Nil means there is no leader election.
+var Leading func() bool
+
+// Error reports the step an apply failed in and how the rollback went
+type Error struct {
+	Step        string
+	Err         error
+	RolledBack  bool  // the previous routes were restored and verified
+	RollbackErr error // set when restoring them failed too
+}
+
+func (e *Error) Error() string {
+	message := fmt.Sprintf("%s failed: %v", e.Step, e.Err)
+	switch {
+	case e.RolledBack:
+		message += "; rolled back to the previous routes"
+	case e.RollbackErr != nil:
+		message += fmt.Sprintf("; rollback failed: %v", e.RollbackErr)
+	}
+	return message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Routes advertises and approves routes as one transaction. The device's
+// current routes are read first and the change is checked against the guard
+// rails. If advertising, approving or reading the new routes back fails, the
+// snapshot is restored and the rollback outcome is posted to Slack on its own.
+// When routes change, the pre-hooks run first and may veto the apply, and the
+// post-hooks run once it succeeded. A successful apply is recorded in the
+// state store along with its trigger.
+func Routes(ctx context.Context, config config.Config, routes []string, trigger state.Trigger) error {
+	// the API reports prefixes in canonical form, so set them that way too
+	routes = utils.CanonicalPrefixes(routes)
+
+	snapshot, err := tailscale.GetRoutes()
+	if err != nil {
+		// nothing was changed yet, so there is nothing to roll back
+		return &Error{Step: StepSnapshot, Err: err}
+	}
+	log.Println("Snapshot of advertised routes: ", snapshot.AdvertisedRoutes, " approved routes: ", snapshot.EnabledRoutes)
+
+	// refuse changes that look like an outage or a bad config, before touching anything
+	approval, err := guard(config.Guard, snapshot.AdvertisedRoutes, routes)
+	if err != nil {
+		return err
+	}
+
+	// hooks only care about changes, not about reapplying the same routes
+	changed := compare(snapshot, routes, routes) != nil
+	input := newHookInput(config, snapshot.AdvertisedRoutes, routes, trigger)
+	if changed {
+		if err := runHooks(ctx, PhasePre, config.Hooks.Pre, input); err != nil {
+			return err
+		}
+	}
+
+	step, err := set(ctx, config, routes, routes)
+	if err == nil {
+		// an approval only counts once the change went through
+		if approval != "" {
+			if err := consumeApproval(config.Guard.ApprovalFile, approval); err != nil {
+				log.Println("Error using up approval: ", err.Error())
+			}
+		}
+		record(config, snapshot.AdvertisedRoutes, routes, trigger)
+		if changed {
+			runHooks(ctx, PhasePost, config.Hooks.Post, input)
+		}
+		return nil
+	}
+
+	applyErr := &Error{Step: step, Err: err}
+
+	// the new leader owns the routes now, rolling back would undo its work
+	if errors.Is(err, ErrNotLeader) {
+		log.Println("Lost leadership during the apply, not rolling back")
+		return applyErr
+	}
+
+	log.Println("Apply failed, rolling back: ", err.Error())
+
+	_, rollbackErr := set(ctx, config, snapshot.AdvertisedRoutes, snapshot.EnabledRoutes)
+	if rollbackErr != nil {
+		log.Println("Rollback failed: ", rollbackErr.Error())
+		applyErr.RollbackErr = rollbackErr
+	} else {
+		log.Println("Rolled back to the previous routes")
+		applyErr.RolledBack = true
+	}
+	slack.PostRollback(err, rollbackErr, config.TailscaleclientId)
+
+	return applyErr
+}
+
+// set runs both steps and verifies them, returning the step that failed
+func set(ctx context.Context, config config.Config, advertised []string, approved []string) (string, error) {
+	if !leading() {
+		return StepAdvertise, ErrNotLeader
+	}
+	if err := advertise(ctx, config, advertised); err != nil {
+		return StepAdvertise, err
+	}
+
+	if !leading() {
+		return StepApprove, ErrNotLeader
+	}
+	log.Println("Trying to update Approved Subnets...")
+	if err := tailscale.SetTailscaleApprovedSubnets(approved); err != nil {
+		return StepApprove, err
+	}
+
+	if err := verify(ctx, config, advertised, approved); err != nil {
+		return StepVerify, err
+	}
+	return "", nil
+}
+
+func leading() bool {
+	return Leading == nil || Leading()
+}
+
+// advertise runs TailscaleCommand with the routes
+func advertise(ctx context.Context, config config.Config, routes []string) error {
+	args, err := config.TailscaleCommand.Expand(routes)
+	if err != nil {
+		return err
+	}
+
+	stdout, stderr, err := utils.RunCommand(ctx, args, config.Command.ExecOptions())
+	if stdout != "" {
+		log.Println(stdout)
+	}
+	if stderr != "" {
+		log.Println("stderr: ", stderr)
+	}
+	return err
+}
+
+// verify reads the routes back until the device reports what was set, or
+// the verify timeout runs out
+func verify(ctx context.Context, config config.Config, advertised []string, approved []string) error {
+	timeout := config.Apply.VerifyTimeout
+	if timeout <= 0 {
+		timeout = defaultVerifyTimeout
+	}
+	interval := config.Apply.VerifyInterval
+	if interval <= 0 {
+		interval = defaultVerifyInterval
+	}
+	deadline := time.Now().Add(time.Duration(timeout) * time.Second)
+
+	for {
+		current, err := tailscale.GetRoutes()
+		if err == nil {
+			err = compare(current, advertised, approved)
+			if err == nil {
+				return nil
+			}
+		}
+
+		if time.Now().Add(time.Duration(interval) * time.Second).After(deadline) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(time.Duration(interval) * time.Second):
+		}
+	}
+}
+
+func compare(current *tailscale.Routes, advertised []string, approved []string) error {
+	added, removed := utils.Diff(current.AdvertisedRoutes, advertised)
+	if len(added)+len(removed) > 0 {
+		return fmt.Errorf("device advertises %d routes, expected %d (missing %v, extra %v)", len(current.AdvertisedRoutes), len(utils.CanonicalPrefixes(advertised)), added, removed)
+	}
+
+	added, removed = utils.Diff(current.EnabledRoutes, approved)
+	if len(added)+len(removed) > 0 {
+		return fmt.Errorf("device has %d approved routes, expected %d (missing %v, extra %v)", len(current.EnabledRoutes), len(utils.CanonicalPrefixes(approved)), added, removed)
+	}
+	return nil
+}
+
+// record adds the applied route set to the history. The apply itself already
+// succeeded, so failing to record it is only logged.
+func record(config config.Config, before []string, routes []string, trigger state.Trigger) {
+	store, err := state.Open(config.State, config.TailscaleclientId)
+	if err != nil {
+		log.Println("Error opening state store: ", err.Error())
+		return
+	}
+	if store == nil {
+		return
+	}
+
+	added, removed := utils.Diff(before, routes)
+	rev := &state.Revision{
+		Time:    time.Now().UTC(),
+		Device:  config.TailscaleclientId,
+		Trigger: trigger,
+		Routes:  utils.CanonicalPrefixes(routes),
+		Added:   added,
+		Removed: removed,
+	}
+	if err := store.Append(rev); err != nil {
+		log.Println("Error recording applied routes: ", err.Error())
+		return
+	}
+	log.Printf("Recorded revision %d, triggered by %s", rev.Number, trigger)
+}
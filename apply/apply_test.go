@@ -0,0 +1,21 @@
+package apply
+
+import (
+	"context"
+	"errors"
+	"tailscale-route-tiller/config"
+	"testing"
+)
+
+func TestSetStopsWithoutLeadership(t *testing.T) {
+	Leading = func() bool { return false }
+	defer func() { Leading = nil }()
+
+	// the command would fail if it ran, so reaching it means the check was skipped
+	cfg := config.Config{TailscaleCommand: config.Command{"false", "%s"}}
+
+	step, err := set(context.Background(), cfg, []string{"10.0.0.0/24"}, []string{"10.0.0.0/24"})
+	if step != StepAdvertise || !errors.Is(err, ErrNotLeader) {
+		t.Errorf("set() = %q, %v, want %q, %v", step, err, StepAdvertise, ErrNotLeader)
+	}
+}
@@ -0,0 +1,170 @@
+package apply
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"tailscale-route-tiller/config"
+	"tailscale-route-tiller/utils"
+)
+
+// Force skips the guard rails, set by the --force flag
+var Force bool
+
+// GuardError is returned when an apply trips a guard rail
+type GuardError struct {
+	Reasons     []string
+	Fingerprint string // identifies the refused change for approval
+}
+
+func (e *GuardError) Error() string {
+	return fmt.Sprintf("apply refused by guard rails: %s; approve it with \"approve %s\" or rerun with --force",
+		strings.Join(e.Reasons, "; "), e.Fingerprint)
+}
+
+// guard checks a change against the configured limits. A tripped change still
+// goes through with Force, or when its fingerprint was approved. The approval
+// it relied on is returned, to be used up once the change was applied.
+func guard(cfg config.Guard, current []string, desired []string) (string, error) {
+	added, removed := utils.Diff(current, desired)
+	total := len(utils.CanonicalPrefixes(desired))
+
+	var reasons, limits []string
+	if cfg.MaxRemoved > 0 && len(removed) > cfg.MaxRemoved {
+		reasons = append(reasons, fmt.Sprintf("%d routes removed, at most %d allowed", len(removed), cfg.MaxRemoved))
+		limits = append(limits, "MaxRemoved")
+	}
+	if cfg.MaxRemovedPercent > 0 && len(current) > 0 {
+		percent := float64(len(removed)) * 100 / float64(len(utils.CanonicalPrefixes(current)))
+		if percent > cfg.MaxRemovedPercent {
+			reasons = append(reasons, fmt.Sprintf("%.0f%% of routes removed, at most %.0f%% allowed", percent, cfg.MaxRemovedPercent))
+			limits = append(limits, "MaxRemovedPercent")
+		}
+	}
+	if cfg.MinTotal > 0 && total < cfg.MinTotal {
+		reasons = append(reasons, fmt.Sprintf("%d routes left, at least %d required", total, cfg.MinTotal))
+		limits = append(limits, "MinTotal")
+	}
+	if cfg.MaxTotal > 0 && total > cfg.MaxTotal {
+		reasons = append(reasons, fmt.Sprintf("%d routes, at most %d allowed", total, cfg.MaxTotal))
+		limits = append(limits, "MaxTotal")
+	}
+
+	if len(reasons) == 0 {
+		return "", nil
+	}
+
+	fingerprint := Fingerprint(removed, limits)
+	if Force {
+		log.Println("Guard rails tripped, applying anyway because of --force: ", strings.Join(reasons, "; "))
+		return "", nil
+	}
+
+	approved, err := hasApproval(cfg.ApprovalFile, fingerprint)
+	if err != nil {
+		log.Println("Error reading approvals: ", err.Error())
+	}
+	if approved {
+		log.Printf("Guard rails tripped, applying anyway because change %s was approved: %s", fingerprint, strings.Join(reasons, "; "))
+		return fingerprint, nil
+	}
+
+	log.Println("Guard rails tripped, added: ", added, " removed: ", removed)
+	return "", &GuardError{Reasons: reasons, Fingerprint: fingerprint}
+}
+
+// Fingerprint identifies a refused change by the routes it removes and the
+// limits it trips. Added routes are left out, so an approval still matches a
+// retry after load balancer addresses rotated in the meantime.
+func Fingerprint(removed []string, limits []string) string {
+	removed = utils.CanonicalPrefixes(removed)
+	sort.Strings(removed)
+
+	sum := sha256.Sum256([]byte(strings.Join(removed, ",") + "|" + strings.Join(limits, ",")))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// Approve records an approval for a refused change in the approval file
+func Approve(cfg config.Guard, fingerprint string) error {
+	if cfg.ApprovalFile == "" {
+		return fmt.Errorf("Guard.ApprovalFile is not configured")
+	}
+
+	f, err := os.OpenFile(cfg.ApprovalFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintln(f, strings.TrimSpace(fingerprint))
+	return err
+}
+
+// readApprovals returns the approved fingerprints, in file order
+func readApprovals(path string) ([]string, error) {
+	buf, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var approvals []string
+	for _, line := range strings.Split(string(buf), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			approvals = append(approvals, line)
+		}
+	}
+	return approvals, nil
+}
+
+// hasApproval reports whether the fingerprint was approved
+func hasApproval(path string, fingerprint string) (bool, error) {
+	if path == "" {
+		return false, nil
+	}
+
+	approvals, err := readApprovals(path)
+	if err != nil {
+		return false, err
+	}
+	for _, approval := range approvals {
+		if approval == fingerprint {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// consumeApproval removes one approval of the fingerprint, so it is only
+// used for a single successful apply
+func consumeApproval(path string, fingerprint string) error {
+	approvals, err := readApprovals(path)
+	if err != nil {
+		return err
+	}
+
+	found := false
+	var rest []string
+	for _, approval := range approvals {
+		if approval == fingerprint && !found {
+			found = true
+			continue
+		}
+		rest = append(rest, approval)
+	}
+	if !found {
+		return nil
+	}
+
+	content := ""
+	if len(rest) > 0 {
+		content = strings.Join(rest, "\n") + "\n"
+	}
+	return os.WriteFile(path, []byte(content), 0600)
+}
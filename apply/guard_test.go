@@ -0,0 +1,233 @@
+package apply
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"tailscale-route-tiller/config"
+	"tailscale-route-tiller/state"
+	"tailscale-route-tiller/tailscale"
+	"testing"
+)
+
+func routeList(n int) []string {
+	routes := make([]string, n)
+	for i := range routes {
+		routes[i] = fmt.Sprintf("10.0.%d.0/24", i)
+	}
+	return routes
+}
+
+func TestGuardLimits(t *testing.T) {
+	ten := routeList(10)
+
+	tests := []struct {
+		name    string
+		cfg     config.Guard
+		current []string
+		desired []string
+		limits  []string
+	}{
+		{"no limits", config.Guard{}, ten, nil, nil},
+		{"removed within MaxRemoved", config.Guard{MaxRemoved: 3}, ten, ten[3:], nil},
+		{"removed over MaxRemoved", config.Guard{MaxRemoved: 3}, ten, ten[4:], []string{"MaxRemoved"}},
+		{"MaxRemoved counts canonical prefixes", config.Guard{MaxRemoved: 1}, []string{"10.0.0.1", "10.0.0.2/32"}, []string{"10.0.0.1/32", "10.0.0.2"}, nil},
+		{"removed within percent", config.Guard{MaxRemovedPercent: 30}, ten, ten[3:], nil},
+		{"removed over percent", config.Guard{MaxRemovedPercent: 30}, ten, ten[4:], []string{"MaxRemovedPercent"}},
+		{"percent of nothing", config.Guard{MaxRemovedPercent: 30}, nil, ten, nil},
+		{"at MinTotal", config.Guard{MinTotal: 5}, ten, ten[5:], nil},
+		{"under MinTotal", config.Guard{MinTotal: 5}, ten, ten[6:], []string{"MinTotal"}},
+		{"at MaxTotal", config.Guard{MaxTotal: 10}, nil, ten, nil},
+		{"over MaxTotal", config.Guard{MaxTotal: 9}, nil, ten, []string{"MaxTotal"}},
+		{"MaxTotal counts canonical prefixes", config.Guard{MaxTotal: 1}, nil, []string{"10.0.0.1", "10.0.0.1/32"}, nil},
+		{"several limits", config.Guard{MaxRemoved: 1, MinTotal: 9}, ten, ten[2:], []string{"MaxRemoved", "MinTotal"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			approval, err := guard(tt.cfg, tt.current, tt.desired)
+			if approval != "" {
+				t.Errorf("guard() used approval %q without an approval file", approval)
+			}
+
+			var guardErr *GuardError
+			if tt.limits == nil {
+				if err != nil {
+					t.Errorf("guard() = %v, want no error", err)
+				}
+				return
+			}
+			if !errors.As(err, &guardErr) {
+				t.Fatalf("guard() = %v, want a GuardError", err)
+			}
+			if len(guardErr.Reasons) != len(tt.limits) {
+				t.Errorf("guard() reasons = %q, want %d", guardErr.Reasons, len(tt.limits))
+			}
+			removed := []string{}
+			for _, route := range tt.current {
+				found := false
+				for _, kept := range tt.desired {
+					found = found || kept == route
+				}
+				if !found {
+					removed = append(removed, route)
+				}
+			}
+			if want := Fingerprint(removed, tt.limits); guardErr.Fingerprint != want {
+				t.Errorf("guard() fingerprint = %s, want %s", guardErr.Fingerprint, want)
+			}
+		})
+	}
+}
+
+func TestGuardForce(t *testing.T) {
+	Force = true
+	defer func() { Force = false }()
+
+	approval, err := guard(config.Guard{MaxRemoved: 1}, routeList(5), nil)
+	if approval != "" || err != nil {
+		t.Errorf("guard() with Force = %q, %v, want no error", approval, err)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	removed := []string{"10.0.1.0/24", "10.0.2.0/24"}
+	limits := []string{"MaxRemoved"}
+	fingerprint := Fingerprint(removed, limits)
+
+	if got := Fingerprint([]string{"10.0.2.0/24", "10.0.1.0/24"}, limits); got != fingerprint {
+		t.Errorf("fingerprint depends on the order of the routes")
+	}
+	if got := Fingerprint([]string{"10.0.1.1/24", "10.0.2.0/24"}, limits); got != fingerprint {
+		t.Errorf("fingerprint depends on the form of the routes")
+	}
+	if got := Fingerprint(removed[:1], limits); got == fingerprint {
+		t.Errorf("fingerprint does not change with the removed routes")
+	}
+	if got := Fingerprint(removed, []string{"MaxRemovedPercent"}); got == fingerprint {
+		t.Errorf("fingerprint does not change with the tripped limits")
+	}
+
+	// the same removal with other routes added, as when load balancer addresses rotate
+	cfg := config.Guard{MaxRemoved: 1}
+	current := []string{"10.0.1.0/24", "10.0.2.0/24", "10.0.3.0/24"}
+	_, first := guard(cfg, current, []string{"10.0.3.0/24", "10.0.4.0/24"})
+	_, retry := guard(cfg, current, []string{"10.0.3.0/24", "10.0.5.0/24"})
+	if first.(*GuardError).Fingerprint != retry.(*GuardError).Fingerprint {
+		t.Errorf("fingerprint changed with the added routes")
+	}
+}
+
+// fakeAPI serves the Tailscale device routes endpoint from memory
+type fakeAPI struct {
+	routes  tailscale.Routes
+	failSet bool
+}
+
+func (f *fakeAPI) RoundTrip(req *http.Request) (*http.Response, error) {
+	status := http.StatusOK
+	switch req.Method {
+	case http.MethodPost:
+		var payload struct {
+			Routes []string `json:"routes"`
+		}
+		json.NewDecoder(req.Body).Decode(&payload)
+		if f.failSet {
+			status = http.StatusInternalServerError
+		} else {
+			// the advertise command does nothing here, so pretend it ran too
+			f.routes = tailscale.Routes{AdvertisedRoutes: payload.Routes, EnabledRoutes: payload.Routes}
+		}
+	}
+
+	body, _ := json.Marshal(f.routes)
+	return &http.Response{StatusCode: status, Status: http.StatusText(status), Body: io.NopCloser(bytes.NewReader(body)), Request: req}, nil
+}
+
+func TestApprovalUsedOnceAfterSuccess(t *testing.T) {
+	before := routeList(4)
+	api := &fakeAPI{}
+	reset := func() { api.routes = tailscale.Routes{AdvertisedRoutes: before, EnabledRoutes: before} }
+	reset()
+
+	transport := http.DefaultTransport
+	http.DefaultTransport = api
+	defer func() { http.DefaultTransport = transport }()
+
+	cfg := config.Config{
+		TailscaleclientId: "n1",
+		TailscaleCommand:  config.Command{"true", "%s"},
+	}
+	cfg.Guard = config.Guard{MaxRemoved: 1, ApprovalFile: filepath.Join(t.TempDir(), "approvals")}
+	cfg.Apply.VerifyTimeout = 1
+	cfg.Apply.VerifyInterval = 1
+	desired := before[2:]
+
+	var guardErr *GuardError
+	err := Routes(context.Background(), cfg, desired, state.Trigger{})
+	if !errors.As(err, &guardErr) {
+		t.Fatalf("Routes() = %v, want a GuardError", err)
+	}
+	if err := Approve(cfg.Guard, guardErr.Fingerprint); err != nil {
+		t.Fatal(err)
+	}
+
+	// a failed apply keeps the approval
+	api.failSet = true
+	var applyErr *Error
+	if err := Routes(context.Background(), cfg, desired, state.Trigger{}); !errors.As(err, &applyErr) || applyErr.Step != StepApprove {
+		t.Fatalf("Routes() = %v, want an approve error", err)
+	}
+	if approved, _ := hasApproval(cfg.Guard.ApprovalFile, guardErr.Fingerprint); !approved {
+		t.Fatal("approval was used up by a failed apply")
+	}
+
+	api.failSet = false
+	reset()
+	if err := Routes(context.Background(), cfg, desired, state.Trigger{}); err != nil {
+		t.Fatalf("Routes() = %v, want the approved change to go through", err)
+	}
+	if approved, _ := hasApproval(cfg.Guard.ApprovalFile, guardErr.Fingerprint); approved {
+		t.Fatal("approval was not used up by a successful apply")
+	}
+	if buf, _ := os.ReadFile(cfg.Guard.ApprovalFile); strings.TrimSpace(string(buf)) != "" {
+		t.Errorf("approval file still holds %q", buf)
+	}
+
+	reset()
+	if err := Routes(context.Background(), cfg, desired, state.Trigger{}); !errors.As(err, &guardErr) {
+		t.Fatalf("Routes() = %v, want the approval to work only once", err)
+	}
+}
+
+func TestConsumeApproval(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "approvals")
+	for _, fingerprint := range []string{"aaa", "bbb", "aaa"} {
+		if err := Approve(config.Guard{ApprovalFile: path}, fingerprint); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := consumeApproval(path, "aaa"); err != nil {
+		t.Fatal(err)
+	}
+	approvals, _ := readApprovals(path)
+	if strings.Join(approvals, ",") != "bbb,aaa" {
+		t.Errorf("approvals after one use = %q, want bbb,aaa", approvals)
+	}
+
+	if err := consumeApproval(path, "ccc"); err != nil {
+		t.Fatal(err)
+	}
+	approvals, _ = readApprovals(path)
+	if len(approvals) != 2 {
+		t.Errorf("using an unknown approval changed the file: %q", approvals)
+	}
+}
@@ -0,0 +1,133 @@
+package apply
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"tailscale-route-tiller/config"
+	"tailscale-route-tiller/slack"
+	"tailscale-route-tiller/state"
+	"tailscale-route-tiller/utils"
+)
+
+// Hook phases, as passed to hooks and reported in HookError
+const (
+	PhasePre  = "pre"
+	PhasePost = "post"
+)
+
+// HookInput is the change a hook gets as JSON on stdin
+type HookInput struct {
+	Phase    string        `json:"phase"`
+	Device   string        `json:"device"`
+	Trigger  state.Trigger `json:"trigger"`
+	Routes   []string      `json:"routes"`   // the full route set being applied
+	Previous []string      `json:"previous"` // the advertised routes before the apply
+	Added    []string      `json:"added"`
+	Removed  []string      `json:"removed"`
+}
+
+// HookError is returned when a pre-hook vetoes an apply
+type HookError struct {
+	Phase string
+	Name  string
+	Err   error
+}
+
+func (e *HookError) Error() string {
+	return fmt.Sprintf("%s-apply hook %s failed: %v", e.Phase, e.Name, e.Err)
+}
+
+func (e *HookError) Unwrap() error {
+	return e.Err
+}
+
+// newHookInput describes the change from the snapshot to the routes
+func newHookInput(config config.Config, before []string, routes []string, trigger state.Trigger) HookInput {
+	added, removed := utils.Diff(before, routes)
+	return HookInput{
+		Device:   config.TailscaleclientId,
+		Trigger:  trigger,
+		Routes:   nonNil(utils.CanonicalPrefixes(routes)),
+		Previous: nonNil(utils.CanonicalPrefixes(before)),
+		Added:    nonNil(added),
+		Removed:  nonNil(removed),
+	}
+}
+
+// runHooks runs the hooks of a phase in order. The first failing pre-hook
+// stops the rest and is returned, unless it has IgnoreFailure set. Post-hooks
+// run after the routes changed, so their failures are only reported.
+func runHooks(ctx context.Context, phase string, hooks []config.Hook, input HookInput) error {
+	if len(hooks) == 0 {
+		return nil
+	}
+
+	input.Phase = phase
+	payload, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+
+	for i, hook := range hooks {
+		name := hook.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+
+		log.Printf("Running %s-apply hook %s", phase, name)
+		err := runHook(ctx, hook, payload, input)
+		if err == nil {
+			continue
+		}
+
+		hookErr := &HookError{Phase: phase, Name: name, Err: err}
+		if phase == PhasePre && !hook.IgnoreFailure {
+			return hookErr
+		}
+		log.Println("Error: ", hookErr.Error())
+		if phase == PhasePost {
+			slack.PostError(hookErr)
+		}
+	}
+	return nil
+}
+
+// runHook runs a single hook with the change on stdin and in its environment
+func runHook(ctx context.Context, hook config.Hook, payload []byte, input HookInput) error {
+	if len(hook.Command) == 0 {
+		return fmt.Errorf("no Command configured")
+	}
+
+	opts := hook.ExecOptions()
+	opts.Stdin = payload
+	opts.Env = map[string]string{}
+	for key, value := range hook.Env {
+		opts.Env[key] = value
+	}
+	opts.Env["ROUTE_TILLER_PHASE"] = input.Phase
+	opts.Env["ROUTE_TILLER_DEVICE"] = input.Device
+	opts.Env["ROUTE_TILLER_TRIGGER"] = input.Trigger.String()
+	opts.Env["ROUTE_TILLER_ROUTES"] = strings.Join(input.Routes, ",")
+	opts.Env["ROUTE_TILLER_ADDED"] = strings.Join(input.Added, ",")
+	opts.Env["ROUTE_TILLER_REMOVED"] = strings.Join(input.Removed, ",")
+
+	stdout, stderr, err := utils.RunCommand(ctx, hook.Command, opts)
+	if stdout != "" {
+		log.Println(stdout)
+	}
+	if stderr != "" && err == nil {
+		log.Println("stderr: ", stderr)
+	}
+	return err
+}
+
+// nonNil keeps empty lists as [] rather than null in the JSON
+func nonNil(list []string) []string {
+	if list == nil {
+		return []string{}
+	}
+	return list
+}
@@ -0,0 +1,278 @@
+package apply
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"tailscale-route-tiller/config"
+	"tailscale-route-tiller/sources"
+	"tailscale-route-tiller/state"
+	"tailscale-route-tiller/tailscale"
+	"tailscale-route-tiller/utils"
+	"time"
+)
+
+// PlanVersion is bumped whenever the plan format changes incompatibly
+const PlanVersion = 1
+
+// ErrDrift is returned when a device changed between plan and apply
+var ErrDrift = errors.New("current routes have drifted since the plan was made")
+
+// Route is a desired route and where it came from, such as "site:app.example.com",
+// "subnet" or "source:<name>"
+type Route struct {
+	Prefix  string   `json:"prefix"`
+	Origins []string `json:"origins"`
+}
+
+// Change is a route the plan adds or removes
+type Change struct {
+	Prefix     string   `json:"prefix"`
+	Origins    []string `json:"origins,omitempty"` // where an added route comes from
+	Advertised bool     `json:"advertised"`        // changes what the device advertises
+	Approved   bool     `json:"approved"`          // changes what is approved
+}
+
+// DevicePlan is the change planned for one device
+type DevicePlan struct {
+	Device  string           `json:"device"`
+	Current tailscale.Routes `json:"current"`
+	Desired []Route          `json:"desired"`
+	Add     []Change         `json:"add"`
+	Remove  []Change         `json:"remove"`
+}
+
+// Plan is the machine readable result of the plan command
+type Plan struct {
+	Version int          `json:"version"`
+	Created time.Time    `json:"created"`
+	Devices []DevicePlan `json:"devices"`
+}
+
+// Desired resolves the sites, subnets and route sources, keeping track of
+// which of them each route came from
+func Desired(config config.Config) ([]Route, error) {
+	origins := map[string][]string{}
+	var order []string
+	add := func(prefix string, origin string) {
+		prefix = utils.CanonicalPrefix(prefix)
+		if _, ok := origins[prefix]; !ok {
+			order = append(order, prefix)
+		}
+		for _, existing := range origins[prefix] {
+			if existing == origin {
+				return
+			}
+		}
+		origins[prefix] = append(origins[prefix], origin)
+	}
+
+	for _, site := range config.Sites {
+		resolved, _, err := utils.PerformDNSLookupsWithTTL([]string{site}, config.EnableIpv6)
+		if err != nil {
+			return nil, err
+		}
+		for _, prefix := range resolved {
+			add(prefix, "site:"+site)
+		}
+	}
+
+	for _, subnet := range config.Subnets {
+		add(subnet, "subnet")
+	}
+
+	sourced, err := sources.Collect(config)
+	if err != nil {
+		return nil, err
+	}
+	for _, route := range sourced {
+		if route.Source == "eni" {
+			add(route.Prefix, "eni")
+		} else {
+			add(route.Prefix, "source:"+route.Source)
+		}
+	}
+
+	routes := make([]Route, 0, len(order))
+	for _, prefix := range order {
+		routes = append(routes, Route{Prefix: prefix, Origins: origins[prefix]})
+	}
+	return routes, nil
+}
+
+// Prefixes returns just the prefixes of the routes
+func Prefixes(routes []Route) []string {
+	prefixes := make([]string, 0, len(routes))
+	for _, route := range routes {
+		prefixes = append(prefixes, route.Prefix)
+	}
+	return prefixes
+}
+
+// NewPlan compares the desired routes with the current routes of the device
+func NewPlan(config config.Config) (*Plan, error) {
+	desired, err := Desired(config)
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := tailscale.GetRoutes()
+	if err != nil {
+		return nil, err
+	}
+
+	device := DevicePlan{
+		Device:  config.TailscaleclientId,
+		Current: *current,
+		Desired: desired,
+		Add:     []Change{},
+		Remove:  []Change{},
+	}
+
+	advertised := lookup(utils.CanonicalPrefixes(current.AdvertisedRoutes))
+	approved := lookup(utils.CanonicalPrefixes(current.EnabledRoutes))
+	wanted := map[string]bool{}
+	for _, route := range desired {
+		wanted[route.Prefix] = true
+		if !advertised[route.Prefix] || !approved[route.Prefix] {
+			device.Add = append(device.Add, Change{
+				Prefix:     route.Prefix,
+				Origins:    route.Origins,
+				Advertised: !advertised[route.Prefix],
+				Approved:   !approved[route.Prefix],
+			})
+		}
+	}
+
+	for _, prefix := range utils.CanonicalPrefixes(append(append([]string{}, current.AdvertisedRoutes...), current.EnabledRoutes...)) {
+		if !wanted[prefix] {
+			device.Remove = append(device.Remove, Change{
+				Prefix:     prefix,
+				Advertised: advertised[prefix],
+				Approved:   approved[prefix],
+			})
+		}
+	}
+
+	return &Plan{Version: PlanVersion, Created: time.Now().UTC(), Devices: []DevicePlan{device}}, nil
+}
+
+// lookup turns a list into a set
+func lookup(list []string) map[string]bool {
+	found := map[string]bool{}
+	for _, entry := range list {
+		found[entry] = true
+	}
+	return found
+}
+
+// HasChanges reports whether applying the plan would change anything
+func (p *Plan) HasChanges() bool {
+	for _, device := range p.Devices {
+		if len(device.Add)+len(device.Remove) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Write stores the plan as indented JSON
+func (p *Plan) Write(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(p)
+}
+
+// Summary writes a human readable overview of the plan
+func (p *Plan) Summary(w io.Writer) {
+	for _, device := range p.Devices {
+		fmt.Fprintf(w, "Device %s: %d desired routes, %d to add, %d to remove\n", device.Device, len(device.Desired), len(device.Add), len(device.Remove))
+		for _, change := range device.Add {
+			fmt.Fprintf(w, "  + %s (%s)%s\n", change.Prefix, strings.Join(change.Origins, ", "), steps(change))
+		}
+		for _, change := range device.Remove {
+			fmt.Fprintf(w, "  - %s%s\n", change.Prefix, steps(change))
+		}
+	}
+}
+
+// steps notes when a change only touches one of advertising and approving
+func steps(change Change) string {
+	switch {
+	case change.Advertised && !change.Approved:
+		return " [advertise only]"
+	case change.Approved && !change.Advertised:
+		return " [approve only]"
+	}
+	return ""
+}
+
+// ReadPlan loads a plan written by the plan command
+func ReadPlan(path string) (*Plan, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &Plan{}
+	if err := json.Unmarshal(buf, plan); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if plan.Version != PlanVersion {
+		return nil, fmt.Errorf("%s: unsupported plan version %d", path, plan.Version)
+	}
+	return plan, nil
+}
+
+// ApplyPlan applies exactly the desired routes of the plan, refusing with
+// ErrDrift when the device no longer has the routes the plan was made against
+func ApplyPlan(ctx context.Context, config config.Config, plan *Plan, trigger state.Trigger) error {
+	var device *DevicePlan
+	for i := range plan.Devices {
+		if plan.Devices[i].Device == config.TailscaleclientId {
+			device = &plan.Devices[i]
+		}
+	}
+	if device == nil {
+		return fmt.Errorf("plan has no entry for device %s", config.TailscaleclientId)
+	}
+
+	current, err := tailscale.GetRoutes()
+	if err != nil {
+		return err
+	}
+	if err := drift(device.Current, *current); err != nil {
+		return err
+	}
+
+	return Routes(ctx, config, Prefixes(device.Desired), trigger)
+}
+
+// drift compares the routes recorded in a plan with the current ones
+func drift(planned tailscale.Routes, current tailscale.Routes) error {
+	var details []string
+
+	added, removed := utils.Diff(planned.AdvertisedRoutes, current.AdvertisedRoutes)
+	sort.Strings(added)
+	sort.Strings(removed)
+	if len(added)+len(removed) > 0 {
+		details = append(details, fmt.Sprintf("advertised routes added %v, removed %v", added, removed))
+	}
+
+	added, removed = utils.Diff(planned.EnabledRoutes, current.EnabledRoutes)
+	sort.Strings(added)
+	sort.Strings(removed)
+	if len(added)+len(removed) > 0 {
+		details = append(details, fmt.Sprintf("approved routes added %v, removed %v", added, removed))
+	}
+
+	if len(details) > 0 {
+		return fmt.Errorf("%w: %s", ErrDrift, strings.Join(details, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package apply
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"tailscale-route-tiller/config"
+	"tailscale-route-tiller/state"
+	"tailscale-route-tiller/tailscale"
+	"testing"
+)
+
+// useFakeAPI routes the Tailscale API calls of a test to the fake
+func useFakeAPI(t *testing.T, routes tailscale.Routes) *fakeAPI {
+	api := &fakeAPI{routes: routes}
+	transport := http.DefaultTransport
+	http.DefaultTransport = api
+	t.Cleanup(func() { http.DefaultTransport = transport })
+	return api
+}
+
+func TestNewPlan(t *testing.T) {
+	useFakeAPI(t, tailscale.Routes{
+		AdvertisedRoutes: []string{"10.0.1.0/24", "10.0.2.0/24", "10.0.4.1", "10.0.7.0/24"},
+		EnabledRoutes:    []string{"10.0.1.0/24", "10.0.3.0/24", "10.0.5.0/24", "10.0.7.0/24"},
+	})
+
+	cfg := config.Config{
+		TailscaleclientId: "n1",
+		Subnets: []string{
+			"10.0.1.5/24", // advertised and approved, in another form
+			"10.0.2.0/24", // advertised, not approved
+			"10.0.3.0/24", // approved, not advertised
+			"10.0.6.1",    // neither
+		},
+	}
+
+	plan, err := NewPlan(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Devices) != 1 || plan.Devices[0].Device != "n1" || plan.Version != PlanVersion {
+		t.Fatalf("NewPlan() = %+v", plan)
+	}
+	device := plan.Devices[0]
+
+	wantAdd := []Change{
+		{Prefix: "10.0.2.0/24", Origins: []string{"subnet"}, Advertised: false, Approved: true},
+		{Prefix: "10.0.3.0/24", Origins: []string{"subnet"}, Advertised: true, Approved: false},
+		{Prefix: "10.0.6.1/32", Origins: []string{"subnet"}, Advertised: true, Approved: true},
+	}
+	if !reflect.DeepEqual(device.Add, wantAdd) {
+		t.Errorf("Add = %+v, want %+v", device.Add, wantAdd)
+	}
+
+	wantRemove := []Change{
+		{Prefix: "10.0.4.1/32", Advertised: true, Approved: false},
+		{Prefix: "10.0.7.0/24", Advertised: true, Approved: true},
+		{Prefix: "10.0.5.0/24", Advertised: false, Approved: true},
+	}
+	if !reflect.DeepEqual(device.Remove, wantRemove) {
+		t.Errorf("Remove = %+v, want %+v", device.Remove, wantRemove)
+	}
+
+	if got := Prefixes(device.Desired); !reflect.DeepEqual(got, []string{"10.0.1.0/24", "10.0.2.0/24", "10.0.3.0/24", "10.0.6.1/32"}) {
+		t.Errorf("Desired = %v", got)
+	}
+	if !plan.HasChanges() {
+		t.Error("HasChanges() = false")
+	}
+
+	var summary strings.Builder
+	plan.Summary(&summary)
+	for _, line := range []string{
+		"+ 10.0.2.0/24 (subnet) [approve only]",
+		"+ 10.0.3.0/24 (subnet) [advertise only]",
+		"+ 10.0.6.1/32 (subnet)\n",
+		"- 10.0.4.1/32 [advertise only]",
+		"- 10.0.5.0/24 [approve only]",
+		"- 10.0.7.0/24\n",
+	} {
+		if !strings.Contains(summary.String(), line) {
+			t.Errorf("Summary() has no line %q:\n%s", line, summary.String())
+		}
+	}
+}
+
+func TestNewPlanWithoutChanges(t *testing.T) {
+	useFakeAPI(t, tailscale.Routes{
+		AdvertisedRoutes: []string{"10.0.1.0/24"},
+		EnabledRoutes:    []string{"10.0.1.0/24"},
+	})
+
+	plan, err := NewPlan(config.Config{TailscaleclientId: "n1", Subnets: []string{"10.0.1.0/24"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.HasChanges() {
+		t.Errorf("HasChanges() = true for %+v", plan.Devices[0])
+	}
+}
+
+func TestDrift(t *testing.T) {
+	planned := tailscale.Routes{
+		AdvertisedRoutes: []string{"10.0.1.0/24", "10.0.2.0/24"},
+		EnabledRoutes:    []string{"10.0.1.0/24"},
+	}
+
+	tests := []struct {
+		name    string
+		current tailscale.Routes
+		drifted bool
+		detail  string
+	}{
+		{"unchanged", planned, false, ""},
+		{"other order and form", tailscale.Routes{AdvertisedRoutes: []string{"10.0.2.1/24", "10.0.1.0/24"}, EnabledRoutes: []string{"10.0.1.0/24"}}, false, ""},
+		{"advertised added", tailscale.Routes{AdvertisedRoutes: []string{"10.0.1.0/24", "10.0.2.0/24", "10.0.3.0/24"}, EnabledRoutes: []string{"10.0.1.0/24"}}, true, "advertised routes added [10.0.3.0/24], removed []"},
+		{"advertised removed", tailscale.Routes{AdvertisedRoutes: []string{"10.0.1.0/24"}, EnabledRoutes: []string{"10.0.1.0/24"}}, true, "advertised routes added [], removed [10.0.2.0/24]"},
+		{"approved changed", tailscale.Routes{AdvertisedRoutes: []string{"10.0.1.0/24", "10.0.2.0/24"}, EnabledRoutes: []string{"10.0.2.0/24"}}, true, "approved routes added [10.0.2.0/24], removed [10.0.1.0/24]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := drift(planned, tt.current)
+			if errors.Is(err, ErrDrift) != tt.drifted {
+				t.Fatalf("drift() = %v, want drifted %v", err, tt.drifted)
+			}
+			if tt.drifted && !strings.Contains(err.Error(), tt.detail) {
+				t.Errorf("drift() = %q, want it to mention %q", err, tt.detail)
+			}
+		})
+	}
+}
+
+func TestApplyPlanRefusesDrift(t *testing.T) {
+	api := useFakeAPI(t, tailscale.Routes{
+		AdvertisedRoutes: []string{"10.0.1.0/24"},
+		EnabledRoutes:    []string{"10.0.1.0/24"},
+	})
+
+	cfg := config.Config{TailscaleclientId: "n1", Subnets: []string{"10.0.2.0/24"}, TailscaleCommand: config.Command{"true", "%s"}}
+	plan, err := NewPlan(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// someone else changed the device after the plan was made
+	api.routes.EnabledRoutes = nil
+	if err := ApplyPlan(context.Background(), cfg, plan, state.Trigger{}); !errors.Is(err, ErrDrift) {
+		t.Errorf("ApplyPlan() = %v, want ErrDrift", err)
+	}
+	if len(api.routes.AdvertisedRoutes) != 1 || api.routes.AdvertisedRoutes[0] != "10.0.1.0/24" {
+		t.Errorf("ApplyPlan() changed the routes to %v despite the drift", api.routes)
+	}
+
+	other := &Plan{Version: PlanVersion, Devices: []DevicePlan{{Device: "n2"}}}
+	if err := ApplyPlan(context.Background(), cfg, other, state.Trigger{}); err == nil || errors.Is(err, ErrDrift) {
+		t.Errorf("ApplyPlan() for another device = %v", err)
+	}
+}
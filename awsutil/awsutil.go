@@ -0,0 +1,45 @@
+package awsutil
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// Options describes how to build an AWS session
+type Options struct {
+	Region   string
+	Endpoint string
+	Profile  string
+	RoleARN  string
+}
+
+// NewSession builds a session from the standard credential chain (environment,
+// shared config and profile, instance role), optionally assuming a role and
+// talking to a custom endpoint such as LocalStack or ElasticMQ
+func NewSession(opts Options) (*session.Session, error) {
+	base := aws.Config{}
+	if opts.Region != "" {
+		base.Region = aws.String(opts.Region)
+	}
+
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            base,
+		Profile:           opts.Profile,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// the role is assumed through the real STS before the endpoint is overridden
+	extra := &aws.Config{}
+	if opts.RoleARN != "" {
+		extra.Credentials = stscreds.NewCredentials(sess, opts.RoleARN)
+	}
+	if opts.Endpoint != "" {
+		extra.Endpoint = aws.String(opts.Endpoint)
+	}
+
+	return sess.Copy(extra), nil
+}
@@ -12,6 +12,7 @@ type CloudTrailEvent struct {
 	Time       time.Time `json:"time"`
 	Region     string    `json:"region"`
 	Detail     Detail    `json:"detail"`
+	Envelope   string    `json:"-"` // how the event arrived, see Unwrap
 }
 
 // Detail holds information about the API call event.
@@ -68,6 +69,7 @@ type Attributes struct {
 
 // RequestParameters includes parameters specific to the API call.
 type RequestParameters struct {
+	NetworkInterfaceId    string      `json:"networkInterfaceId"` // only set on DeleteNetworkInterface
 	SubnetId              string      `json:"subnetId"`
 	Description           string      `json:"description"`
 	GroupSet              GroupSet    `json:"groupSet"`
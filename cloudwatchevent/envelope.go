@@ -0,0 +1,209 @@
+package cloudwatchevent
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// The envelopes an event can arrive in
+const (
+	EnvelopeEventBridge = "eventbridge"
+	EnvelopeSNS         = "sns"
+	EnvelopeS3          = "s3"
+)
+
+// Unwrapped is one event taken out of its envelope
+type Unwrapped struct {
+	Raw      []byte
+	Envelope string
+}
+
+// snsEnvelope is the body SNS delivers to an SQS subscription
+type snsEnvelope struct {
+	Type             string `json:"Type"`
+	MessageId        string `json:"MessageId"`
+	TopicArn         string `json:"TopicArn"`
+	Subject          string `json:"Subject"`
+	Message          string `json:"Message"`
+	Timestamp        string `json:"Timestamp"`
+	SignatureVersion string `json:"SignatureVersion"`
+	Signature        string `json:"Signature"`
+	SigningCertURL   string `json:"SigningCertURL"`
+}
+
+// s3Notification is an S3 event notification, which can hold several records
+type s3Notification struct {
+	Records []struct {
+		EventVersion string    `json:"eventVersion"`
+		EventSource  string    `json:"eventSource"`
+		AwsRegion    string    `json:"awsRegion"`
+		EventTime    time.Time `json:"eventTime"`
+		EventName    string    `json:"eventName"`
+		S3           struct {
+			Bucket struct {
+				Name string `json:"name"`
+				ARN  string `json:"arn"`
+			} `json:"bucket"`
+			Object struct {
+				Key       string `json:"key"`
+				Size      int64  `json:"size"`
+				ETag      string `json:"eTag"`
+				Sequencer string `json:"sequencer"`
+			} `json:"object"`
+		} `json:"s3"`
+		ResponseElements map[string]string `json:"responseElements"`
+	} `json:"Records"`
+	Event string `json:"Event"` // only set on s3:TestEvent
+}
+
+// SNSVerifier checks SNS message signatures against a configured certificate
+type SNSVerifier struct {
+	key *rsa.PublicKey
+}
+
+// NewSNSVerifier loads the PEM encoded signing certificate of the SNS topic
+func NewSNSVerifier(certificateFile string) (*SNSVerifier, error) {
+	buf, err := os.ReadFile(certificateFile)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, fmt.Errorf("%s does not contain a PEM certificate", certificateFile)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("SNS signing certificate does not hold an RSA key")
+	}
+
+	return &SNSVerifier{key: key}, nil
+}
+
+func (v *SNSVerifier) verify(envelope snsEnvelope) error {
+	signature, err := base64.StdEncoding.DecodeString(envelope.Signature)
+	if err != nil {
+		return fmt.Errorf("invalid SNS signature encoding: %v", err)
+	}
+
+	stringToSign := "Message\n" + envelope.Message + "\n" +
+		"MessageId\n" + envelope.MessageId + "\n"
+	if envelope.Subject != "" {
+		stringToSign += "Subject\n" + envelope.Subject + "\n"
+	}
+	stringToSign += "Timestamp\n" + envelope.Timestamp + "\n" +
+		"TopicArn\n" + envelope.TopicArn + "\n" +
+		"Type\n" + envelope.Type + "\n"
+
+	switch envelope.SignatureVersion {
+	case "1":
+		digest := sha1.Sum([]byte(stringToSign))
+		return rsa.VerifyPKCS1v15(v.key, crypto.SHA1, digest[:], signature)
+	case "2":
+		digest := sha256.Sum256([]byte(stringToSign))
+		return rsa.VerifyPKCS1v15(v.key, crypto.SHA256, digest[:], signature)
+	}
+	return fmt.Errorf("unsupported SNS signature version %q", envelope.SignatureVersion)
+}
+
+// Unwrap detects the envelope of an SQS message body and returns the events
+// inside it. SNS envelopes are verified when a verifier is given, and may
+// themselves carry an S3 notification.
+func Unwrap(body []byte, verifier *SNSVerifier) ([]Unwrapped, error) {
+	var probe map[string]json.RawMessage
+	if err := json.Unmarshal(body, &probe); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case probe["detail-type"] != nil && probe["source"] != nil:
+		return []Unwrapped{{Raw: body, Envelope: EnvelopeEventBridge}}, nil
+
+	case probe["Type"] != nil && probe["TopicArn"] != nil:
+		var envelope snsEnvelope
+		if err := json.Unmarshal(body, &envelope); err != nil {
+			return nil, err
+		}
+		if envelope.Type != "Notification" {
+			return nil, fmt.Errorf("unexpected SNS message type %q", envelope.Type)
+		}
+		if verifier != nil {
+			if err := verifier.verify(envelope); err != nil {
+				return nil, fmt.Errorf("SNS signature verification failed: %v", err)
+			}
+		}
+
+		inner, err := Unwrap([]byte(envelope.Message), nil)
+		if err != nil {
+			return nil, fmt.Errorf("SNS message: %v", err)
+		}
+		for i := range inner {
+			inner[i].Envelope = EnvelopeSNS + "/" + inner[i].Envelope
+		}
+		return inner, nil
+
+	case probe["Records"] != nil || probe["Event"] != nil:
+		return unwrapS3(body)
+	}
+
+	return nil, errors.New("unknown message envelope")
+}
+
+// unwrapS3 turns each S3 record into an EventBridge style event
+func unwrapS3(body []byte) ([]Unwrapped, error) {
+	var notification s3Notification
+	if err := json.Unmarshal(body, &notification); err != nil {
+		return nil, err
+	}
+
+	// S3 sends a test event when a notification is configured
+	if notification.Event == "s3:TestEvent" {
+		return nil, nil
+	}
+
+	var events []Unwrapped
+	for _, record := range notification.Records {
+		if record.EventSource != "aws:s3" {
+			return nil, fmt.Errorf("unexpected record source %q", record.EventSource)
+		}
+
+		raw, err := json.Marshal(map[string]interface{}{
+			"version":     "0",
+			"id":          record.ResponseElements["x-amz-request-id"] + "-" + record.S3.Object.Sequencer,
+			"detail-type": "S3 Event Notification",
+			"source":      "aws.s3",
+			"time":        record.EventTime,
+			"region":      record.AwsRegion,
+			"resources":   []string{record.S3.Bucket.ARN},
+			"detail": map[string]interface{}{
+				"eventVersion": record.EventVersion,
+				"eventSource":  "s3.amazonaws.com",
+				"eventName":    record.EventName,
+				"eventTime":    record.EventTime,
+				"awsRegion":    record.AwsRegion,
+				"bucket":       record.S3.Bucket,
+				"object":       record.S3.Object,
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, Unwrapped{Raw: raw, Envelope: EnvelopeS3})
+	}
+
+	return events, nil
+}
@@ -0,0 +1,219 @@
+package cloudwatchevent
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testEventBridge = `{"version":"0","id":"e1","detail-type":"AWS API Call via CloudTrail","source":"aws.ec2","detail":{"eventName":"CreateNetworkInterface"}}`
+const testS3 = `{"Records":[{"eventVersion":"2.1","eventSource":"aws:s3","awsRegion":"us-west-2","eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"routes","arn":"arn:aws:s3:::routes"},"object":{"key":"routes.txt","sequencer":"01"}},"responseElements":{"x-amz-request-id":"req1"}}]}`
+const testS3TestEvent = `{"Service":"Amazon S3","Event":"s3:TestEvent","Bucket":"routes"}`
+
+// testVerifier writes a self-signed certificate and loads it as the SNS signing certificate
+func testVerifier(t *testing.T) (*SNSVerifier, *rsa.PrivateKey) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "sns.us-west-2.amazonaws.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "sns.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	verifier, err := NewSNSVerifier(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return verifier, key
+}
+
+func testEnvelope(message string, subject string) snsEnvelope {
+	return snsEnvelope{
+		Type:             "Notification",
+		MessageId:        "m1",
+		TopicArn:         "arn:aws:sns:us-west-2:123456789012:route-tiller",
+		Subject:          subject,
+		Message:          message,
+		Timestamp:        "2024-01-02T03:04:05.000Z",
+		SignatureVersion: "2",
+	}
+}
+
+// sign signs the envelope the way SNS does for its signature version
+func sign(t *testing.T, key *rsa.PrivateKey, envelope snsEnvelope) snsEnvelope {
+	t.Helper()
+
+	stringToSign := "Message\n" + envelope.Message + "\n" +
+		"MessageId\n" + envelope.MessageId + "\n"
+	if envelope.Subject != "" {
+		stringToSign += "Subject\n" + envelope.Subject + "\n"
+	}
+	stringToSign += "Timestamp\n" + envelope.Timestamp + "\n" +
+		"TopicArn\n" + envelope.TopicArn + "\n" +
+		"Type\n" + envelope.Type + "\n"
+
+	var signature []byte
+	var err error
+	if envelope.SignatureVersion == "1" {
+		digest := sha1.Sum([]byte(stringToSign))
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA1, digest[:])
+	} else {
+		digest := sha256.Sum256([]byte(stringToSign))
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope.Signature = base64.StdEncoding.EncodeToString(signature)
+	return envelope
+}
+
+func TestSNSVerifierVerify(t *testing.T) {
+	verifier, key := testVerifier(t)
+
+	version1 := testEnvelope(testEventBridge, "")
+	version1.SignatureVersion = "1"
+
+	tampered := sign(t, key, testEnvelope(testEventBridge, ""))
+	tampered.Message = `{"source":"evil"}`
+
+	subjectAdded := sign(t, key, testEnvelope(testEventBridge, ""))
+	subjectAdded.Subject = "added later"
+
+	unsupported := sign(t, key, testEnvelope(testEventBridge, ""))
+	unsupported.SignatureVersion = "3"
+
+	badEncoding := testEnvelope(testEventBridge, "")
+	badEncoding.Signature = "not base64!"
+
+	tests := []struct {
+		name     string
+		envelope snsEnvelope
+		ok       bool
+	}{
+		{"signature version 1", sign(t, key, version1), true},
+		{"signature version 2", sign(t, key, testEnvelope(testEventBridge, "")), true},
+		{"with a subject", sign(t, key, testEnvelope(testEventBridge, "route update")), true},
+		{"tampered message", tampered, false},
+		{"subject added after signing", subjectAdded, false},
+		{"unsupported version", unsupported, false},
+		{"invalid signature encoding", badEncoding, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifier.verify(tt.envelope)
+			if (err == nil) != tt.ok {
+				t.Errorf("verify() = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestUnwrap(t *testing.T) {
+	verifier, key := testVerifier(t)
+
+	marshal := func(envelope snsEnvelope) string {
+		buf, err := json.Marshal(envelope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf)
+	}
+
+	tampered := sign(t, key, testEnvelope(testEventBridge, ""))
+	tampered.Message = testS3
+
+	subscription := sign(t, key, testEnvelope("confirm", ""))
+	subscription.Type = "SubscriptionConfirmation"
+
+	tests := []struct {
+		name      string
+		body      string
+		verifier  *SNSVerifier
+		envelopes []string
+		ok        bool
+	}{
+		{"eventbridge", testEventBridge, nil, []string{EnvelopeEventBridge}, true},
+		{"sns", marshal(sign(t, key, testEnvelope(testEventBridge, ""))), verifier, []string{"sns/eventbridge"}, true},
+		{"sns without a subject or verifier", marshal(testEnvelope(testEventBridge, "")), nil, []string{"sns/eventbridge"}, true},
+		{"sns with a tampered message", marshal(tampered), verifier, nil, false},
+		{"sns unsigned", marshal(testEnvelope(testEventBridge, "")), verifier, nil, false},
+		{"sns subscription confirmation", marshal(subscription), verifier, nil, false},
+		{"sns wrapping s3", marshal(sign(t, key, testEnvelope(testS3, "Amazon S3 Notification"))), verifier, []string{"sns/s3"}, true},
+		{"s3", testS3, nil, []string{EnvelopeS3}, true},
+		{"s3 test event", testS3TestEvent, nil, nil, true},
+		{"sns wrapping the s3 test event", marshal(sign(t, key, testEnvelope(testS3TestEvent, ""))), verifier, nil, true},
+		{"unknown envelope", `{"hello":"world"}`, nil, nil, false},
+		{"not json", `hello`, nil, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events, err := Unwrap([]byte(tt.body), tt.verifier)
+			if (err == nil) != tt.ok {
+				t.Fatalf("Unwrap() = %v, want ok %v", err, tt.ok)
+			}
+			if len(events) != len(tt.envelopes) {
+				t.Fatalf("Unwrap() returned %d events, want %d", len(events), len(tt.envelopes))
+			}
+			for i, event := range events {
+				if event.Envelope != tt.envelopes[i] {
+					t.Errorf("event %d envelope = %q, want %q", i, event.Envelope, tt.envelopes[i])
+				}
+			}
+		})
+	}
+}
+
+func TestUnwrapS3Event(t *testing.T) {
+	events, err := Unwrap([]byte(testS3), nil)
+	if err != nil || len(events) != 1 {
+		t.Fatalf("Unwrap() = %v, %v", events, err)
+	}
+
+	var event struct {
+		ID         string `json:"id"`
+		DetailType string `json:"detail-type"`
+		Source     string `json:"source"`
+		Detail     struct {
+			EventName string `json:"eventName"`
+			Object    struct {
+				Key string `json:"key"`
+			} `json:"object"`
+		} `json:"detail"`
+	}
+	if err := json.Unmarshal(events[0].Raw, &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.ID != "req1-01" || event.Source != "aws.s3" || event.DetailType != "S3 Event Notification" ||
+		event.Detail.EventName != "ObjectCreated:Put" || event.Detail.Object.Key != "routes.txt" {
+		t.Errorf("unexpected S3 event %s", events[0].Raw)
+	}
+}
@@ -0,0 +1,138 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"tailscale-route-tiller/utils"
+	"time"
+)
+
+// defaultCommandTimeout bounds TailscaleCommand when no Timeout is configured
+const defaultCommandTimeout = 60
+
+// RoutesPlaceholder is replaced by the comma separated routes in TailscaleCommand
+const RoutesPlaceholder = "%s"
+
+// Command is a command line given either as a list of arguments or as a
+// single string, which is split like a shell would, honouring quotes
+type Command []string
+
+// UnmarshalYAML accepts both the string and the list form
+func (c *Command) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var list []string
+	if err := unmarshal(&list); err == nil {
+		*c = list
+		return nil
+	}
+
+	var line string
+	if err := unmarshal(&line); err != nil {
+		return err
+	}
+	args, err := SplitCommand(line)
+	if err != nil {
+		return err
+	}
+	*c = args
+	return nil
+}
+
+// Expand returns the arguments with the placeholder replaced by the routes.
+// The routes always end up in a single argument.
+func (c Command) Expand(routes []string) ([]string, error) {
+	if len(c) == 0 {
+		return nil, errors.New("TailscaleCommand is not set")
+	}
+
+	joined := strings.Join(routes, ",")
+	found := false
+	args := make([]string, len(c))
+	for i, arg := range c {
+		if strings.Contains(arg, RoutesPlaceholder) {
+			found = true
+		}
+		args[i] = strings.ReplaceAll(arg, RoutesPlaceholder, joined)
+	}
+	if !found {
+		return nil, fmt.Errorf("TailscaleCommand has no %s placeholder for the routes", RoutesPlaceholder)
+	}
+	return args, nil
+}
+
+// ExecOptions converts the configured options for utils.RunCommand
+func (o CommandOptions) ExecOptions() utils.CommandOptions {
+	timeout := o.Timeout
+	if timeout <= 0 {
+		timeout = defaultCommandTimeout
+	}
+	return utils.CommandOptions{
+		Timeout:  time.Duration(timeout) * time.Second,
+		Env:      o.Env,
+		CleanEnv: o.CleanEnv,
+	}
+}
+
+// SplitCommand splits a command line on whitespace, the way sh does. Single
+// quotes keep their content as is. Inside double quotes a backslash only
+// escapes $, `, ", \ and newline, and is kept before anything else.
+func SplitCommand(line string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	inArg := false
+	var quote rune
+	escaped := false
+
+	for _, r := range line {
+		switch {
+		case escaped:
+			escaped = false
+			if r == '\n' {
+				// a line continuation
+				continue
+			}
+			if quote == '"' && !strings.ContainsRune("$`\"\\", r) {
+				current.WriteRune('\\')
+			}
+			current.WriteRune(r)
+			inArg = true
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '\\':
+			escaped = true
+		case quote == '"':
+			if r == '"' {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote in command %q", quote, line)
+	}
+	if escaped {
+		return nil, fmt.Errorf("trailing backslash in command %q", line)
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
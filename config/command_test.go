@@ -0,0 +1,85 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitCommand(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want []string
+	}{
+		{"words", "tailscale up --advertise-routes=%s", []string{"tailscale", "up", "--advertise-routes=%s"}},
+		{"extra whitespace", "  a \t b\n c  ", []string{"a", "b", "c"}},
+		{"empty", "", nil},
+		{"single quotes", `echo 'a  b' 'c"d' 'e\f'`, []string{"echo", "a  b", `c"d`, `e\f`}},
+		{"double quotes", `echo "a  b" "c'd"`, []string{"echo", "a  b", "c'd"}},
+		{"empty quotes", `echo "" ''`, []string{"echo", "", ""}},
+		{"quotes inside a word", `--flag="a b"c`, []string{"--flag=a bc"}},
+		{"backslash outside quotes", `a\ b h\i`, []string{"a b", "hi"}},
+		{"backslash in double quotes is kept", `"h\i"`, []string{`h\i`}},
+		{"escapes in double quotes", `"\$ \` + "`" + ` \" \\"`, []string{"$ ` \" \\"}},
+		{"backslash in single quotes", `'\\'`, []string{`\\`}},
+		{"line continuation", "a \\\n b", []string{"a", "b"}},
+		{"line continuation in double quotes", "\"a\\\nb\"", []string{"ab"}},
+		{"escaped quote", `don\'t`, []string{"don't"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := SplitCommand(tt.line)
+			if err != nil {
+				t.Fatalf("SplitCommand(%q): %v", tt.line, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("SplitCommand(%q) = %q, want %q", tt.line, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitCommandRejects(t *testing.T) {
+	for _, line := range []string{`echo "a`, `echo 'a`, `echo a\`} {
+		if args, err := SplitCommand(line); err == nil {
+			t.Errorf("SplitCommand(%q) = %q, want an error", line, args)
+		}
+	}
+}
+
+func TestExpand(t *testing.T) {
+	routes := []string{"10.0.0.0/24", "10.0.1.0/24"}
+
+	tests := []struct {
+		name    string
+		command Command
+		want    []string
+		ok      bool
+	}{
+		{"own argument", Command{"tailscale", "set", "--advertise-routes", "%s"}, []string{"tailscale", "set", "--advertise-routes", "10.0.0.0/24,10.0.1.0/24"}, true},
+		{"inside an argument", Command{"tailscale", "up", "--advertise-routes=%s"}, []string{"tailscale", "up", "--advertise-routes=10.0.0.0/24,10.0.1.0/24"}, true},
+		{"positional shell argument", Command{"sh", "-c", `echo "$1"`, "sh", "%s"}, []string{"sh", "-c", `echo "$1"`, "sh", "10.0.0.0/24,10.0.1.0/24"}, true},
+		{"missing placeholder", Command{"tailscale", "up"}, nil, false},
+		{"not set", nil, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.command.Expand(routes)
+			if (err == nil) != tt.ok {
+				t.Fatalf("Expand() = %v, want ok %v", err, tt.ok)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Expand() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// the command itself is not changed
+	command := Command{"tailscale", "--advertise-routes=%s"}
+	command.Expand(routes)
+	if command[1] != "--advertise-routes=%s" {
+		t.Errorf("Expand() changed the command to %q", command)
+	}
+}
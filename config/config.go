@@ -11,14 +11,75 @@ import (
 
 // Config is a struct for our YAML data
 type Config struct {
-	Subnets           []string `yaml:"subnets"`
-	Sites             []string `yaml:"sites"`
-	TailscaleCommand  string   `yaml:"TailscaleCommand"`
-	EnableIpv6        bool     `yaml:"EnableIpv6"`
-	TailscaleclientId string   `yaml:"TailscaleclientId"`
-	TailscaleKey      string   `yaml:"TailscaleKey"`
-	Slack             Slack    `yaml:"Slack"`
-	SQS               SQS      `yaml:"SQS"`
+	Subnets           []string       `yaml:"subnets"`
+	Sites             []string       `yaml:"sites"`
+	TailscaleCommand  Command        `yaml:"TailscaleCommand"`
+	Command           CommandOptions `yaml:"Command"`
+	Apply             Apply          `yaml:"Apply"`
+	Guard             Guard          `yaml:"Guard"`
+	State             State          `yaml:"State"`
+	Hooks             Hooks          `yaml:"Hooks"`
+	EnableIpv6        bool           `yaml:"EnableIpv6"`
+	TailscaleclientId string         `yaml:"TailscaleclientId"`
+	TailscaleKey      string         `yaml:"TailscaleKey"`
+	Slack             Slack          `yaml:"Slack"`
+	SQS               SQS            `yaml:"SQS"`
+	Worker            Worker         `yaml:"Worker"`
+	EventRoutes       EventRoutes    `yaml:"EventRoutes"`
+	Rules             []Rule         `yaml:"Rules"`
+	SiteMappings      []SiteMapping  `yaml:"SiteMappings"`
+	Dedupe            Dedupe         `yaml:"Dedupe"`
+	Leader            Leader         `yaml:"Leader"`
+	Sources           Sources        `yaml:"Sources"`
+	Server            Server         `yaml:"Server"`
+}
+
+// CommandOptions control how TailscaleCommand runs
+type CommandOptions struct {
+	Timeout  int               `yaml:"Timeout"`  // seconds, default 60
+	Env      map[string]string `yaml:"Env"`      // extra environment variables
+	CleanEnv bool              `yaml:"CleanEnv"` // only pass PATH and Env
+}
+
+// Apply controls how an applied route set is verified
+type Apply struct {
+	VerifyTimeout  int `yaml:"VerifyTimeout"`  // seconds to wait for the device to report the new routes, default 30
+	VerifyInterval int `yaml:"VerifyInterval"` // seconds between checks, default 3
+}
+
+// Guard refuses applies that would change suspiciously many routes
+type Guard struct {
+	MaxRemoved        int     `yaml:"MaxRemoved"`        // routes removed per apply, 0 disables
+	MaxRemovedPercent float64 `yaml:"MaxRemovedPercent"` // percentage of the advertised routes removed per apply, 0 disables
+	MinTotal          int     `yaml:"MinTotal"`          // fewest routes an apply may leave
+	MaxTotal          int     `yaml:"MaxTotal"`          // most routes an apply may leave, 0 disables
+	ApprovalFile      string  `yaml:"ApprovalFile"`      // approved change fingerprints, written by the approve command
+}
+
+// State records every applied route set for the history and rollback commands
+type State struct {
+	Backend  string `yaml:"Backend"`  // file or s3, empty disables the history
+	Path     string `yaml:"Path"`     // JSON lines file for the file backend
+	Bucket   string `yaml:"Bucket"`   // S3 bucket
+	Prefix   string `yaml:"Prefix"`   // key prefix, default "route-tiller"
+	Region   string `yaml:"Region"`   // S3 region
+	Endpoint string `yaml:"Endpoint"` // S3 endpoint, e.g. MinIO or LocalStack
+	Profile  string `yaml:"Profile"`
+	RoleARN  string `yaml:"RoleARN"`
+}
+
+// Hooks run commands around every apply that changes routes
+type Hooks struct {
+	Pre  []Hook `yaml:"Pre"`  // run before anything is changed, a failure vetoes the apply
+	Post []Hook `yaml:"Post"` // run after the new routes were verified
+}
+
+// Hook is a command that gets the change as JSON on stdin
+type Hook struct {
+	Name           string  `yaml:"Name"`
+	Command        Command `yaml:"Command"`
+	IgnoreFailure  bool    `yaml:"IgnoreFailure"` // a failing pre-hook only logs instead of vetoing
+	CommandOptions `yaml:",inline"`
 }
 
 type Slack struct {
@@ -27,8 +88,143 @@ type Slack struct {
 }
 
 type SQS struct {
-	QueueURL string `yaml:"QueueURL"`
-	Region   string `yaml:"Region"`
+	QueueURL           string `yaml:"QueueURL"`
+	Region             string `yaml:"Region"`
+	Endpoint           string `yaml:"Endpoint"`
+	Profile            string `yaml:"Profile"`
+	RoleARN            string `yaml:"RoleARN"`
+	MaxMessages        int64  `yaml:"MaxMessages"`
+	WaitTimeSeconds    int64  `yaml:"WaitTimeSeconds"`
+	VisibilityTimeout  int64  `yaml:"VisibilityTimeout"` // seconds, 0 uses the queue default
+	MaxReceiveCount    int    `yaml:"MaxReceiveCount"`
+	DeadLetterQueueURL string `yaml:"DeadLetterQueueURL"`
+	QuarantineDir      string `yaml:"QuarantineDir"`
+	SNSCertificateFile string `yaml:"SNSCertificateFile"` // verify SNS envelopes against this PEM certificate
+}
+
+// Sources lists the optional external route sources
+type Sources struct {
+	Exec    []ExecSource    `yaml:"Exec"`
+	Files   []FileSource    `yaml:"Files"`
+	URLs    []URLSource     `yaml:"URLs"`
+	Route53 []Route53Source `yaml:"Route53"`
+	Consul  []ConsulSource  `yaml:"Consul"`
+}
+
+// ExecSource runs an external plugin binary that returns routes as JSON
+type ExecSource struct {
+	Name    string   `yaml:"Name"`
+	Command string   `yaml:"Command"`
+	Args    []string `yaml:"Args"`
+	Timeout int      `yaml:"Timeout"` // seconds
+}
+
+// FileSource reads a list of CIDRs and hostnames from a local file
+type FileSource struct {
+	Path   string `yaml:"Path"`
+	Format string `yaml:"Format"` // auto, lines or json
+}
+
+// URLSource polls a list of CIDRs and hostnames from an HTTP endpoint
+type URLSource struct {
+	URL          string            `yaml:"URL"`
+	Format       string            `yaml:"Format"`       // auto, lines or json
+	PollInterval int               `yaml:"PollInterval"` // seconds
+	Headers      map[string]string `yaml:"Headers"`
+}
+
+// Route53Source enumerates the records of a Route53 hosted zone
+type Route53Source struct {
+	HostedZoneId string   `yaml:"HostedZoneId"`
+	Region       string   `yaml:"Region"`
+	Endpoint     string   `yaml:"Endpoint"`
+	Include      []string `yaml:"Include"`      // glob patterns
+	IncludeRegex []string `yaml:"IncludeRegex"` // regular expressions
+}
+
+// ConsulSource advertises the healthy instances of Consul services
+type ConsulSource struct {
+	Address    string   `yaml:"Address"`
+	Token      string   `yaml:"Token"`
+	Datacenter string   `yaml:"Datacenter"`
+	Services   []string `yaml:"Services"`
+	Tags       []string `yaml:"Tags"`
+	WaitTime   int      `yaml:"WaitTime"` // seconds
+}
+
+// Worker holds the settings for the SQS worker loop
+type Worker struct {
+	Debounce          int `yaml:"Debounce"`          // seconds without new messages before a batch is processed
+	MaxBatchAge       int `yaml:"MaxBatchAge"`       // seconds a batch may keep growing
+	SettleMaxWait     int `yaml:"SettleMaxWait"`     // seconds to wait for DNS to reflect the events
+	SettleInterval    int `yaml:"SettleInterval"`    // seconds between DNS polls while settling
+	SettleMinWait     int `yaml:"SettleMinWait"`     // seconds to wait for a delete with no known address when the sites were never resolved
+	ReconcileInterval int `yaml:"ReconcileInterval"` // seconds between periodic full reconciles, 0 disables them
+}
+
+// EventRoutes advertises ENI addresses straight from create/delete events
+type EventRoutes struct {
+	Enabled   bool   `yaml:"Enabled"`
+	StateFile string `yaml:"StateFile"`
+	Prune     bool   `yaml:"Prune"`    // drop interfaces that no longer exist on the periodic reconcile
+	Region    string `yaml:"Region"`   // where the interfaces live, defaults to the SQS region
+	Endpoint  string `yaml:"Endpoint"` // EC2 endpoint, e.g. LocalStack
+	Profile   string `yaml:"Profile"`
+	RoleARN   string `yaml:"RoleARN"`
+}
+
+// Rule maps an EventBridge style event pattern to a worker action
+type Rule struct {
+	Name        string   `yaml:"Name"`
+	Pattern     string   `yaml:"Pattern"`     // inline JSON pattern
+	PatternFile string   `yaml:"PatternFile"` // or a file, such as the EventBridge rule itself
+	Action      string   `yaml:"Action"`      // reconcile, resolve-sites, notify or ignore
+	Sites       []string `yaml:"Sites"`       // sites to re-resolve for resolve-sites
+}
+
+// SiteMapping ties a load balancer to the sites that resolve to it
+type SiteMapping struct {
+	DescriptionPrefix string   `yaml:"DescriptionPrefix"` // e.g. "ELB app/my-alb/"
+	LoadBalancer      string   `yaml:"LoadBalancer"`      // ELB name, e.g. "my-alb"
+	Sites             []string `yaml:"Sites"`
+}
+
+// Dedupe remembers processed event IDs so redelivered events are skipped
+type Dedupe struct {
+	Backend  string `yaml:"Backend"`  // bolt or dynamodb, empty disables deduplication
+	Path     string `yaml:"Path"`     // bolt database file
+	Table    string `yaml:"Table"`    // DynamoDB table with a string partition key "id"
+	Region   string `yaml:"Region"`   // DynamoDB region
+	Endpoint string `yaml:"Endpoint"` // DynamoDB endpoint, e.g. DynamoDB Local
+	TTL      int    `yaml:"TTL"`      // seconds an event ID is remembered
+	Profile  string `yaml:"Profile"`
+	RoleARN  string `yaml:"RoleARN"`
+}
+
+// Leader makes sure only one of several workers applies route changes
+type Leader struct {
+	Backend       string `yaml:"Backend"`       // file or dynamodb, empty disables leader election
+	Path          string `yaml:"Path"`          // lock file for single-host setups
+	Table         string `yaml:"Table"`         // DynamoDB table with a string partition key "id"
+	Region        string `yaml:"Region"`        // DynamoDB region
+	Endpoint      string `yaml:"Endpoint"`      // DynamoDB endpoint, e.g. DynamoDB Local
+	Name          string `yaml:"Name"`          // lease name, defaults to the Tailscale client ID
+	LeaseDuration int    `yaml:"LeaseDuration"` // seconds a DynamoDB lease lasts without renewal
+	Profile       string `yaml:"Profile"`
+	RoleARN       string `yaml:"RoleARN"`
+}
+
+// Server receives events over HTTP for the serve command
+type Server struct {
+	Listen       string   `yaml:"Listen"`       // address to listen on, default ":8080"
+	BearerTokens []string `yaml:"BearerTokens"` // accepted "Authorization: Bearer" tokens
+	HMACSecret   string   `yaml:"HMACSecret"`   // shared secret for "X-Signature-256: sha256=<hex>" signatures
+	RateLimit    float64  `yaml:"RateLimit"`    // requests per second across all callers
+	Burst        int      `yaml:"Burst"`        // requests allowed above the rate in a burst
+	QueueSize    int      `yaml:"QueueSize"`    // accepted requests waiting to be processed
+
+	TailscaleWebhookSecret string `yaml:"TailscaleWebhookSecret"` // enables /tailscale for tailnet webhooks
+	TailscaleDeviceName    string `yaml:"TailscaleDeviceName"`    // also match our router by name, not just node ID
 }
 
 var ActiveConfig *Config
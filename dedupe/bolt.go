@@ -0,0 +1,99 @@
+package dedupe
+
+import (
+	"encoding/binary"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const defaultBoltPath = "dedupe.db"
+
+var eventsBucket = []byte("events")
+
+type boltStore struct {
+	db    *bolt.DB
+	ttl   time.Duration
+	marks int
+}
+
+func openBolt(path string, ttl time.Duration) (*boltStore, error) {
+	if path == "" {
+		path = defaultBoltPath
+	}
+
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(eventsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &boltStore{db: db, ttl: ttl}, nil
+}
+
+func (s *boltStore) Seen(id string) (bool, error) {
+	seen := false
+	err := s.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(eventsBucket).Get([]byte(id))
+		if len(value) == 8 {
+			expires := int64(binary.BigEndian.Uint64(value))
+			seen = time.Now().Unix() < expires
+		}
+		return nil
+	})
+	return seen, err
+}
+
+func (s *boltStore) Mark(id string) error {
+	expires := make([]byte, 8)
+	binary.BigEndian.PutUint64(expires, uint64(time.Now().Add(s.ttl).Unix()))
+
+	s.marks++
+	prune := s.marks%100 == 0
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(eventsBucket)
+		if err := bucket.Put([]byte(id), expires); err != nil {
+			return err
+		}
+		if prune {
+			return pruneExpired(bucket)
+		}
+		return nil
+	})
+}
+
+// pruneExpired drops event IDs whose TTL has run out so the file does not grow forever
+func pruneExpired(bucket *bolt.Bucket) error {
+	now := time.Now().Unix()
+	var expired [][]byte
+
+	err := bucket.ForEach(func(key, value []byte) error {
+		if len(value) != 8 || int64(binary.BigEndian.Uint64(value)) <= now {
+			expired = append(expired, append([]byte(nil), key...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, key := range expired {
+		if err := bucket.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,102 @@
+package dedupe
+
+import (
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func countEvents(t *testing.T, store *boltStore) int {
+	t.Helper()
+	count := 0
+	err := store.db.View(func(tx *bolt.Tx) error {
+		count = tx.Bucket(eventsBucket).Stats().KeyN
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestBoltStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedupe.db")
+	store, err := openBolt(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if seen, err := store.Seen("e1"); seen || err != nil {
+		t.Errorf("Seen() before Mark = %v, %v", seen, err)
+	}
+	if err := store.Mark("e1"); err != nil {
+		t.Fatal(err)
+	}
+	if seen, err := store.Seen("e1"); !seen || err != nil {
+		t.Errorf("Seen() after Mark = %v, %v", seen, err)
+	}
+
+	// event IDs outlive a restart
+	store.Close()
+	store, err = openBolt(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if seen, _ := store.Seen("e1"); !seen {
+		t.Error("Seen() forgot the event after reopening")
+	}
+}
+
+func TestBoltStoreExpiry(t *testing.T) {
+	store, err := openBolt(filepath.Join(t.TempDir(), "dedupe.db"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if err := store.Mark("live"); err != nil {
+		t.Fatal(err)
+	}
+
+	// everything marked from here on has already expired
+	store.ttl = -time.Second
+	if err := store.Mark("expired"); err != nil {
+		t.Fatal(err)
+	}
+	if seen, _ := store.Seen("expired"); seen {
+		t.Error("Seen() reports an expired event")
+	}
+
+	err = store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(eventsBucket).Put([]byte("malformed"), []byte("x"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seen, _ := store.Seen("malformed"); seen {
+		t.Error("Seen() reports an event with a malformed expiry")
+	}
+
+	// every 100th mark prunes what has expired
+	for i := 3; i < 100; i++ {
+		if err := store.Mark("old-" + strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := countEvents(t, store); got != 100 {
+		t.Fatalf("%d events stored before pruning, want 100", got)
+	}
+	if err := store.Mark("last"); err != nil {
+		t.Fatal(err)
+	}
+	if got := countEvents(t, store); got != 1 {
+		t.Errorf("%d events left after pruning, want only the live one", got)
+	}
+	if seen, _ := store.Seen("live"); !seen {
+		t.Error("pruning dropped an event that has not expired")
+	}
+}
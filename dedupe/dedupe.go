@@ -0,0 +1,36 @@
+package dedupe
+
+import (
+	"fmt"
+	"tailscale-route-tiller/config"
+	"time"
+)
+
+const defaultTTL = 24 * 60 * 60
+
+// Store remembers which events have already been processed
+type Store interface {
+	// Seen reports whether an event ID was processed and has not expired yet
+	Seen(id string) (bool, error)
+	// Mark records an event ID as processed
+	Mark(id string) error
+	Close() error
+}
+
+// Open returns the configured store, or nil when deduplication is disabled
+func Open(cfg config.Dedupe) (Store, error) {
+	ttl := time.Duration(cfg.TTL) * time.Second
+	if cfg.TTL <= 0 {
+		ttl = defaultTTL * time.Second
+	}
+
+	switch cfg.Backend {
+	case "":
+		return nil, nil
+	case "bolt":
+		return openBolt(cfg.Path, ttl)
+	case "dynamodb":
+		return openDynamo(cfg, ttl)
+	}
+	return nil, fmt.Errorf("unknown dedupe backend %q", cfg.Backend)
+}
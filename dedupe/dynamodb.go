@@ -0,0 +1,70 @@
+package dedupe
+
+import (
+	"strconv"
+	"tailscale-route-tiller/awsutil"
+	"tailscale-route-tiller/config"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// dynamoStore keeps event IDs in a DynamoDB table shared by several workers.
+// The "expires" attribute can be used as the table's TTL attribute.
+type dynamoStore struct {
+	svc   *dynamodb.DynamoDB
+	table string
+	ttl   time.Duration
+}
+
+func openDynamo(cfg config.Dedupe, ttl time.Duration) (*dynamoStore, error) {
+	sess, err := awsutil.NewSession(awsutil.Options{
+		Region:   cfg.Region,
+		Endpoint: cfg.Endpoint,
+		Profile:  cfg.Profile,
+		RoleARN:  cfg.RoleARN,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &dynamoStore{svc: dynamodb.New(sess), table: cfg.Table, ttl: ttl}, nil
+}
+
+func (s *dynamoStore) Seen(id string) (bool, error) {
+	result, err := s.svc.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(s.table),
+		Key:            map[string]*dynamodb.AttributeValue{"id": {S: aws.String(id)}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return false, err
+	}
+
+	// DynamoDB deletes expired items lazily, so check the expiry ourselves
+	expires, ok := result.Item["expires"]
+	if !ok || expires.N == nil {
+		return false, nil
+	}
+	unix, err := strconv.ParseInt(*expires.N, 10, 64)
+	if err != nil {
+		return false, err
+	}
+	return time.Now().Unix() < unix, nil
+}
+
+func (s *dynamoStore) Mark(id string) error {
+	_, err := s.svc.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(s.table),
+		Item: map[string]*dynamodb.AttributeValue{
+			"id":      {S: aws.String(id)},
+			"expires": {N: aws.String(strconv.FormatInt(time.Now().Add(s.ttl).Unix(), 10))},
+		},
+	})
+	return err
+}
+
+func (s *dynamoStore) Close() error {
+	return nil
+}
@@ -0,0 +1,123 @@
+package enistore
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// DefaultPath is used when no state file is configured
+const DefaultPath = "eni-routes.json"
+
+// Store persists the routes learned from network interface events, keyed by ENI ID
+type Store struct {
+	path       string
+	lock       sync.Mutex
+	Interfaces map[string][]string `json:"interfaces"`
+}
+
+// Open loads the store from disk, starting empty when the file does not exist yet
+func Open(path string) (*Store, error) {
+	if path == "" {
+		path = DefaultPath
+	}
+
+	store := &Store{path: path, Interfaces: map[string][]string{}}
+
+	buf, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(buf, store); err != nil {
+		return nil, err
+	}
+	if store.Interfaces == nil {
+		store.Interfaces = map[string][]string{}
+	}
+	return store, nil
+}
+
+// Add records the prefixes of a network interface
+func (s *Store) Add(eniID string, prefixes []string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.Interfaces[eniID] = prefixes
+	return s.save()
+}
+
+// Remove forgets a network interface and returns the prefixes it had
+func (s *Store) Remove(eniID string) ([]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	prefixes, ok := s.Interfaces[eniID]
+	if !ok {
+		return nil, nil
+	}
+	delete(s.Interfaces, eniID)
+	return prefixes, s.save()
+}
+
+// Lookup returns the prefixes of a network interface
+func (s *Store) Lookup(eniID string) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.Interfaces[eniID]
+}
+
+// IDs returns the stored network interface IDs, sorted
+func (s *Store) IDs() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ids := make([]string, 0, len(s.Interfaces))
+	for id := range s.Interfaces {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Prefixes returns every stored prefix, sorted
+func (s *Store) Prefixes() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var prefixes []string
+	for _, list := range s.Interfaces {
+		prefixes = append(prefixes, list...)
+	}
+	sort.Strings(prefixes)
+	return prefixes
+}
+
+// save writes the store atomically so a crash never leaves a truncated file
+func (s *Store) save() error {
+	buf, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".eni-routes-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
@@ -0,0 +1,90 @@
+package enistore
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "eni-routes.json")
+	store, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := store.IDs(); len(ids) != 0 {
+		t.Fatalf("new store holds %v", ids)
+	}
+
+	if err := store.Add("eni-b", []string{"10.0.0.2/32", "10.0.0.3/32"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Add("eni-a", []string{"10.0.0.1/32"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := store.Lookup("eni-b"); !reflect.DeepEqual(got, []string{"10.0.0.2/32", "10.0.0.3/32"}) {
+		t.Errorf("Lookup(eni-b) = %v", got)
+	}
+	if got := store.Lookup("eni-unknown"); got != nil {
+		t.Errorf("Lookup(eni-unknown) = %v, want nothing", got)
+	}
+	if got := store.IDs(); !reflect.DeepEqual(got, []string{"eni-a", "eni-b"}) {
+		t.Errorf("IDs() = %v, want sorted", got)
+	}
+	if got := store.Prefixes(); !reflect.DeepEqual(got, []string{"10.0.0.1/32", "10.0.0.2/32", "10.0.0.3/32"}) {
+		t.Errorf("Prefixes() = %v", got)
+	}
+
+	// a reopened store has everything that was added
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(reopened.Interfaces, store.Interfaces) {
+		t.Errorf("reopened store = %v, want %v", reopened.Interfaces, store.Interfaces)
+	}
+
+	removed, err := store.Remove("eni-b")
+	if err != nil || !reflect.DeepEqual(removed, []string{"10.0.0.2/32", "10.0.0.3/32"}) {
+		t.Errorf("Remove(eni-b) = %v, %v", removed, err)
+	}
+	if removed, err := store.Remove("eni-b"); removed != nil || err != nil {
+		t.Errorf("removing eni-b again = %v, %v, want nothing", removed, err)
+	}
+
+	reopened, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reopened.IDs(); !reflect.DeepEqual(got, []string{"eni-a"}) {
+		t.Errorf("reopened store after Remove holds %v", got)
+	}
+
+	// saving leaves no temporary files behind
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 1 {
+		t.Errorf("directory holds %d files, want only the store", len(entries))
+	}
+}
+
+func TestOpenErrors(t *testing.T) {
+	dir := t.TempDir()
+
+	empty := filepath.Join(dir, "empty.json")
+	os.WriteFile(empty, []byte(`{}`), 0600)
+	store, err := Open(empty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Add("eni-a", []string{"10.0.0.1/32"}); err != nil {
+		t.Errorf("Add() to a store without interfaces = %v", err)
+	}
+
+	corrupt := filepath.Join(dir, "corrupt.json")
+	os.WriteFile(corrupt, []byte(`not json`), 0600)
+	if _, err := Open(corrupt); err == nil {
+		t.Error("Open() read a corrupt file without an error")
+	}
+}
@@ -0,0 +1,256 @@
+package eventpattern
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Pattern is a parsed EventBridge event pattern. It supports exact values,
+// prefix, suffix, anything-but, exists and numeric matching.
+type Pattern struct {
+	root map[string]interface{}
+}
+
+// Parse reads and validates a JSON event pattern
+func Parse(data []byte) (*Pattern, error) {
+	var root map[string]interface{}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&root); err != nil {
+		return nil, fmt.Errorf("invalid event pattern: %v", err)
+	}
+
+	if err := validate(root, ""); err != nil {
+		return nil, err
+	}
+
+	return &Pattern{root: root}, nil
+}
+
+// Match reports whether a raw JSON event matches the pattern
+func (p *Pattern) Match(event []byte) (bool, error) {
+	var root map[string]interface{}
+
+	decoder := json.NewDecoder(bytes.NewReader(event))
+	decoder.UseNumber()
+	if err := decoder.Decode(&root); err != nil {
+		return false, fmt.Errorf("invalid event: %v", err)
+	}
+
+	return matchObject(p.root, root), nil
+}
+
+func validate(pattern map[string]interface{}, path string) error {
+	for key, value := range pattern {
+		field := strings.TrimPrefix(path+"."+key, ".")
+
+		switch value := value.(type) {
+		case map[string]interface{}:
+			if err := validate(value, field); err != nil {
+				return err
+			}
+		case []interface{}:
+			for _, item := range value {
+				if matcher, ok := item.(map[string]interface{}); ok {
+					if err := validateMatcher(matcher, field); err != nil {
+						return err
+					}
+				}
+			}
+		default:
+			return fmt.Errorf("event pattern %s: values must be arrays or objects", field)
+		}
+	}
+	return nil
+}
+
+func validateMatcher(matcher map[string]interface{}, field string) error {
+	if len(matcher) != 1 {
+		return fmt.Errorf("event pattern %s: a matcher must have exactly one key", field)
+	}
+
+	for kind, arg := range matcher {
+		switch kind {
+		case "prefix", "suffix":
+			if _, ok := arg.(string); !ok {
+				return fmt.Errorf("event pattern %s: %s needs a string", field, kind)
+			}
+		case "exists":
+			if _, ok := arg.(bool); !ok {
+				return fmt.Errorf("event pattern %s: exists needs true or false", field)
+			}
+		case "anything-but":
+			nested, ok := arg.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			for nestedKind := range nested {
+				if nestedKind != "prefix" && nestedKind != "suffix" {
+					return fmt.Errorf("event pattern %s: anything-but only takes prefix or suffix, not %q", field, nestedKind)
+				}
+			}
+			return validateMatcher(nested, field)
+		case "numeric":
+			conditions, ok := arg.([]interface{})
+			if !ok || len(conditions) == 0 || len(conditions)%2 != 0 {
+				return fmt.Errorf("event pattern %s: numeric needs operator and value pairs", field)
+			}
+			for i := 0; i < len(conditions); i += 2 {
+				op, _ := conditions[i].(string)
+				if _, err := toFloat(conditions[i+1]); err != nil || !validOperator(op) {
+					return fmt.Errorf("event pattern %s: invalid numeric condition %v %v", field, conditions[i], conditions[i+1])
+				}
+			}
+		default:
+			return fmt.Errorf("event pattern %s: unsupported matcher %q", field, kind)
+		}
+	}
+	return nil
+}
+
+func matchObject(pattern map[string]interface{}, event map[string]interface{}) bool {
+	for key, expected := range pattern {
+		value, present := event[key]
+
+		switch expected := expected.(type) {
+		case map[string]interface{}:
+			// a missing object has no fields, which only exists: false matches
+			nested, ok := value.(map[string]interface{})
+			if !ok {
+				nested = map[string]interface{}{}
+			}
+			if !matchObject(expected, nested) {
+				return false
+			}
+		case []interface{}:
+			if !matchField(expected, value, present) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// matchField reports whether any of the allowed values matches the event
+// value. Array values in the event match when any of their elements does.
+func matchField(allowed []interface{}, value interface{}, present bool) bool {
+	values := []interface{}{value}
+	if list, ok := value.([]interface{}); ok {
+		values = list
+	}
+
+	for _, rule := range allowed {
+		if matcher, ok := rule.(map[string]interface{}); ok {
+			if exists, ok := matcher["exists"].(bool); ok {
+				if exists == present {
+					return true
+				}
+				continue
+			}
+		}
+
+		if !present {
+			continue
+		}
+
+		for _, item := range values {
+			if matchValue(rule, item) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchValue(rule interface{}, value interface{}) bool {
+	matcher, ok := rule.(map[string]interface{})
+	if !ok {
+		return equal(rule, value)
+	}
+
+	for kind, arg := range matcher {
+		switch kind {
+		case "prefix":
+			s, ok := value.(string)
+			return ok && strings.HasPrefix(s, arg.(string))
+		case "suffix":
+			s, ok := value.(string)
+			return ok && strings.HasSuffix(s, arg.(string))
+		case "anything-but":
+			switch arg := arg.(type) {
+			case []interface{}:
+				for _, excluded := range arg {
+					if equal(excluded, value) {
+						return false
+					}
+				}
+				return true
+			case map[string]interface{}:
+				return !matchValue(arg, value)
+			default:
+				return !equal(arg, value)
+			}
+		case "numeric":
+			number, err := toFloat(value)
+			if err != nil {
+				return false
+			}
+			conditions := arg.([]interface{})
+			for i := 0; i < len(conditions); i += 2 {
+				limit, _ := toFloat(conditions[i+1])
+				if !compare(conditions[i].(string), number, limit) {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+func equal(expected interface{}, value interface{}) bool {
+	if expectedNumber, ok := expected.(json.Number); ok {
+		a, err := toFloat(expectedNumber)
+		if err != nil {
+			return false
+		}
+		b, err := toFloat(value)
+		return err == nil && a == b
+	}
+	return expected == value
+}
+
+func toFloat(value interface{}) (float64, error) {
+	number, ok := value.(json.Number)
+	if !ok {
+		return 0, fmt.Errorf("not a number: %v", value)
+	}
+	return number.Float64()
+}
+
+func validOperator(op string) bool {
+	switch op {
+	case "=", "<", "<=", ">", ">=":
+		return true
+	}
+	return false
+}
+
+func compare(op string, a float64, b float64) bool {
+	switch op {
+	case "=":
+		return a == b
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	}
+	return false
+}
@@ -0,0 +1,130 @@
+package eventpattern
+
+import "testing"
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+		event   string
+		want    bool
+	}{
+		{"exact value", `{"source": ["aws.ec2"]}`, `{"source": "aws.ec2"}`, true},
+		{"exact value mismatch", `{"source": ["aws.ec2"]}`, `{"source": "aws.s3"}`, false},
+		{"any of several values", `{"source": ["aws.s3", "aws.ec2"]}`, `{"source": "aws.ec2"}`, true},
+		{"missing field", `{"source": ["aws.ec2"]}`, `{}`, false},
+		{"nested object", `{"detail": {"eventName": ["CreateNetworkInterface"]}}`, `{"detail": {"eventName": "CreateNetworkInterface"}}`, true},
+		{"nested object missing", `{"detail": {"eventName": ["CreateNetworkInterface"]}}`, `{"detail": "CreateNetworkInterface"}`, false},
+		{"every field must match", `{"source": ["aws.ec2"], "detail-type": ["x"]}`, `{"source": "aws.ec2", "detail-type": "y"}`, false},
+		{"extra event fields are ignored", `{"source": ["aws.ec2"]}`, `{"source": "aws.ec2", "region": "us-west-2"}`, true},
+		{"exact number", `{"count": [5]}`, `{"count": 5.0}`, true},
+		{"number does not match string", `{"count": [5]}`, `{"count": "5"}`, false},
+		{"null value", `{"error": [null]}`, `{"error": null}`, true},
+
+		{"prefix", `{"d": [{"prefix": "ELB app/"}]}`, `{"d": "ELB app/my-alb/123"}`, true},
+		{"prefix mismatch", `{"d": [{"prefix": "ELB app/"}]}`, `{"d": "ELB net/my-nlb/123"}`, false},
+		{"prefix on number", `{"d": [{"prefix": "1"}]}`, `{"d": 12}`, false},
+		{"suffix", `{"d": [{"suffix": ".example.com"}]}`, `{"d": "app.example.com"}`, true},
+		{"suffix mismatch", `{"d": [{"suffix": ".example.com"}]}`, `{"d": "app.example.org"}`, false},
+
+		{"anything-but value", `{"e": [{"anything-but": "Delete"}]}`, `{"e": "Create"}`, true},
+		{"anything-but value excluded", `{"e": [{"anything-but": "Delete"}]}`, `{"e": "Delete"}`, false},
+		{"anything-but list", `{"e": [{"anything-but": ["A", "B"]}]}`, `{"e": "C"}`, true},
+		{"anything-but list excluded", `{"e": [{"anything-but": ["A", "B"]}]}`, `{"e": "B"}`, false},
+		{"anything-but number", `{"n": [{"anything-but": [1, 2]}]}`, `{"n": 2}`, false},
+		{"anything-but prefix", `{"e": [{"anything-but": {"prefix": "Delete"}}]}`, `{"e": "CreateNetworkInterface"}`, true},
+		{"anything-but prefix excluded", `{"e": [{"anything-but": {"prefix": "Delete"}}]}`, `{"e": "DeleteNetworkInterface"}`, false},
+		{"anything-but needs the field", `{"e": [{"anything-but": "Delete"}]}`, `{}`, false},
+
+		{"exists true", `{"e": [{"exists": true}]}`, `{"e": "x"}`, true},
+		{"exists true missing", `{"e": [{"exists": true}]}`, `{}`, false},
+		{"exists false", `{"e": [{"exists": false}]}`, `{}`, true},
+		{"exists false present", `{"e": [{"exists": false}]}`, `{"e": "x"}`, false},
+		{"exists true null", `{"e": [{"exists": true}]}`, `{"e": null}`, true},
+		{"exists false without the parent", `{"detail": {"errorCode": [{"exists": false}]}}`, `{"source": "aws.ec2"}`, true},
+		{"exists false with the parent", `{"detail": {"errorCode": [{"exists": false}]}}`, `{"detail": {"eventName": "x"}}`, true},
+		{"exists false present in the parent", `{"detail": {"errorCode": [{"exists": false}]}}`, `{"detail": {"errorCode": "x"}}`, false},
+		{"exists true without the parent", `{"detail": {"errorCode": [{"exists": true}]}}`, `{}`, false},
+		{"anything-but suffix", `{"e": [{"anything-but": {"suffix": ".test"}}]}`, `{"e": "app.example.com"}`, true},
+		{"anything-but suffix excluded", `{"e": [{"anything-but": {"suffix": ".test"}}]}`, `{"e": "app.test"}`, false},
+
+		{"numeric range", `{"n": [{"numeric": [">", 0, "<=", 5]}]}`, `{"n": 5}`, true},
+		{"numeric below range", `{"n": [{"numeric": [">", 0, "<=", 5]}]}`, `{"n": 0}`, false},
+		{"numeric above range", `{"n": [{"numeric": [">", 0, "<=", 5]}]}`, `{"n": 5.5}`, false},
+		{"numeric equal", `{"n": [{"numeric": ["=", 3]}]}`, `{"n": 3}`, true},
+		{"numeric lower bound", `{"n": [{"numeric": [">=", 3, "<", 4]}]}`, `{"n": 3}`, true},
+		{"numeric on string", `{"n": [{"numeric": [">", 0]}]}`, `{"n": "7"}`, false},
+
+		{"array value with a match", `{"tags": ["b"]}`, `{"tags": ["a", "b"]}`, true},
+		{"array value without a match", `{"tags": ["c"]}`, `{"tags": ["a", "b"]}`, false},
+		{"array value with prefix", `{"tags": [{"prefix": "team-"}]}`, `{"tags": ["env-prod", "team-net"]}`, true},
+		{"empty array value", `{"tags": ["a"]}`, `{"tags": []}`, false},
+		{"array value exists", `{"tags": [{"exists": true}]}`, `{"tags": []}`, true},
+
+		{"mixed matchers", `{"e": ["Exact", {"prefix": "Pre"}]}`, `{"e": "Prefixed"}`, true},
+		{"empty pattern matches everything", `{}`, `{"source": "aws.ec2"}`, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pattern, err := Parse([]byte(tt.pattern))
+			if err != nil {
+				t.Fatalf("Parse(%s): %v", tt.pattern, err)
+			}
+			got, err := pattern.Match([]byte(tt.event))
+			if err != nil {
+				t.Fatalf("Match(%s): %v", tt.event, err)
+			}
+			if got != tt.want {
+				t.Errorf("pattern %s against %s = %v, want %v", tt.pattern, tt.event, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchInvalidEvent(t *testing.T) {
+	pattern, err := Parse([]byte(`{"source": ["aws.ec2"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pattern.Match([]byte(`not json`)); err == nil {
+		t.Error("expected an error for an invalid event")
+	}
+}
+
+func TestParseRejects(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+	}{
+		{"invalid json", `{"source": [`},
+		{"not an object", `["aws.ec2"]`},
+		{"plain string value", `{"source": "aws.ec2"}`},
+		{"plain number value", `{"count": 5}`},
+		{"nested plain value", `{"detail": {"eventName": "x"}}`},
+		{"matcher with two keys", `{"d": [{"prefix": "a", "suffix": "b"}]}`},
+		{"empty matcher", `{"d": [{}]}`},
+		{"unsupported matcher", `{"d": [{"wildcard": "a*"}]}`},
+		{"prefix without string", `{"d": [{"prefix": 1}]}`},
+		{"suffix without string", `{"d": [{"suffix": true}]}`},
+		{"exists without bool", `{"d": [{"exists": "yes"}]}`},
+		{"anything-but with bad matcher", `{"d": [{"anything-but": {"wildcard": "a"}}]}`},
+		{"anything-but with prefix number", `{"d": [{"anything-but": {"prefix": 1}}]}`},
+		{"anything-but with exists", `{"d": [{"anything-but": {"exists": true}}]}`},
+		{"anything-but with numeric", `{"d": [{"anything-but": {"numeric": [">", 1]}}]}`},
+		{"anything-but with anything-but", `{"d": [{"anything-but": {"anything-but": "a"}}]}`},
+		{"numeric without list", `{"n": [{"numeric": 5}]}`},
+		{"numeric empty", `{"n": [{"numeric": []}]}`},
+		{"numeric odd length", `{"n": [{"numeric": [">", 1, "<"]}]}`},
+		{"numeric bad operator", `{"n": [{"numeric": ["!=", 1]}]}`},
+		{"numeric non-number", `{"n": [{"numeric": [">", "one"]}]}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Parse([]byte(tt.pattern)); err == nil {
+				t.Errorf("Parse(%s) succeeded, want an error", tt.pattern)
+			}
+		})
+	}
+}
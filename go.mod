@@ -4,8 +4,10 @@ go 1.20
 
 require (
 	github.com/aws/aws-sdk-go v1.50.9
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/miekg/dns v1.1.55
 	github.com/spf13/cobra v1.7.0
+	go.etcd.io/bbolt v1.3.7
 	gopkg.in/yaml.v2 v2.4.0
 )
 
@@ -0,0 +1,85 @@
+package leader
+
+import (
+	"context"
+	"strconv"
+	"tailscale-route-tiller/awsutil"
+	"tailscale-route-tiller/config"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// dynamoLease is a lease kept in DynamoDB with conditional writes, for
+// workers on several hosts. An expired lease can be taken over by anyone.
+type dynamoLease struct {
+	svc      *dynamodb.DynamoDB
+	table    string
+	name     string
+	holder   string
+	duration time.Duration
+}
+
+func newDynamoLease(cfg config.Leader, name string, holder string, duration time.Duration) (*dynamoLease, error) {
+	sess, err := awsutil.NewSession(awsutil.Options{
+		Region:   cfg.Region,
+		Endpoint: cfg.Endpoint,
+		Profile:  cfg.Profile,
+		RoleARN:  cfg.RoleARN,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &dynamoLease{
+		svc:      dynamodb.New(sess),
+		table:    cfg.Table,
+		name:     name,
+		holder:   holder,
+		duration: duration,
+	}, nil
+}
+
+func (l *dynamoLease) TryAcquire(ctx context.Context) (bool, error) {
+	now := time.Now()
+
+	_, err := l.svc.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(l.table),
+		Item: map[string]*dynamodb.AttributeValue{
+			"id":      {S: aws.String(l.name)},
+			"holder":  {S: aws.String(l.holder)},
+			"expires": {N: aws.String(strconv.FormatInt(now.Add(l.duration).UnixMilli(), 10))},
+		},
+		ConditionExpression: aws.String("attribute_not_exists(id) OR holder = :holder OR expires < :now"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":holder": {S: aws.String(l.holder)},
+			":now":    {N: aws.String(strconv.FormatInt(now.UnixMilli(), 10))},
+		},
+	})
+
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (l *dynamoLease) Release() error {
+	_, err := l.svc.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName:           aws.String(l.table),
+		Key:                 map[string]*dynamodb.AttributeValue{"id": {S: aws.String(l.name)}},
+		ConditionExpression: aws.String("holder = :holder"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":holder": {S: aws.String(l.holder)},
+		},
+	})
+
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,57 @@
+package leader
+
+import (
+	"context"
+	"os"
+	"syscall"
+)
+
+const defaultLockPath = "route-tiller.lock"
+
+// fileLock is a flock based lock for workers running on the same host. The
+// kernel drops it when the process exits, so it never goes stale.
+type fileLock struct {
+	path string
+	file *os.File
+}
+
+func newFileLock(path string) (*fileLock, error) {
+	if path == "" {
+		path = defaultLockPath
+	}
+	return &fileLock{path: path}, nil
+}
+
+func (l *fileLock) TryAcquire(ctx context.Context) (bool, error) {
+	if l.file != nil {
+		return true, nil
+	}
+
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return false, err
+	}
+
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		file.Close()
+		return false, nil
+	}
+	if err != nil {
+		file.Close()
+		return false, err
+	}
+
+	l.file = file
+	return true, nil
+}
+
+func (l *fileLock) Release() error {
+	if l.file == nil {
+		return nil
+	}
+	err := syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	l.file.Close()
+	l.file = nil
+	return err
+}
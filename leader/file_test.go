@@ -0,0 +1,36 @@
+package leader
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileLock(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "route-tiller.lock")
+
+	first, _ := newFileLock(path)
+	second, _ := newFileLock(path)
+
+	if ok, err := first.TryAcquire(ctx); !ok || err != nil {
+		t.Fatalf("first TryAcquire() = %v, %v, want true", ok, err)
+	}
+	if ok, err := first.TryAcquire(ctx); !ok || err != nil {
+		t.Fatalf("renewing TryAcquire() = %v, %v, want true", ok, err)
+	}
+	if ok, err := second.TryAcquire(ctx); ok || err != nil {
+		t.Fatalf("second TryAcquire() = %v, %v, want false while the first holds the lock", ok, err)
+	}
+
+	if err := first.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := second.TryAcquire(ctx); !ok || err != nil {
+		t.Fatalf("second TryAcquire() = %v, %v, want true after the first released it", ok, err)
+	}
+	if ok, err := first.TryAcquire(ctx); ok || err != nil {
+		t.Fatalf("first TryAcquire() = %v, %v, want false after the second took over", ok, err)
+	}
+	second.Release()
+}
@@ -0,0 +1,127 @@
+package leader
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync/atomic"
+	"tailscale-route-tiller/config"
+	"time"
+)
+
+const defaultLeaseDuration = 30
+
+// Lock is a lease that only one worker can hold at a time
+type Lock interface {
+	// TryAcquire takes or renews the lease and reports whether we hold it
+	TryAcquire(ctx context.Context) (bool, error)
+	Release() error
+}
+
+// Elector keeps trying to hold the lease and tracks whether this worker leads
+type Elector struct {
+	ID       string
+	lock     Lock
+	interval time.Duration
+	leading  atomic.Bool
+	onChange func(leading bool)
+	stopped  chan struct{} // closed when Run returns
+}
+
+// New returns an elector for the configured backend, or nil when leader election is disabled
+func New(cfg config.Leader, name string, onChange func(leading bool)) (*Elector, error) {
+	hostname, _ := os.Hostname()
+	id := fmt.Sprintf("%s-%d", hostname, os.Getpid())
+
+	if cfg.Name != "" {
+		name = cfg.Name
+	}
+
+	leaseDuration := time.Duration(cfg.LeaseDuration) * time.Second
+	if cfg.LeaseDuration <= 0 {
+		leaseDuration = defaultLeaseDuration * time.Second
+	}
+
+	var lock Lock
+	var err error
+
+	switch cfg.Backend {
+	case "":
+		return nil, nil
+	case "file":
+		lock, err = newFileLock(cfg.Path)
+	case "dynamodb":
+		lock, err = newDynamoLease(cfg, name, id, leaseDuration)
+	default:
+		return nil, fmt.Errorf("unknown leader backend %q", cfg.Backend)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// renew well within the lease so a slow call does not lose it
+	return &Elector{ID: id, lock: lock, interval: leaseDuration / 3, onChange: onChange, stopped: make(chan struct{})}, nil
+}
+
+// IsLeader reports whether this worker currently holds the lease
+func (e *Elector) IsLeader() bool {
+	return e.leading.Load()
+}
+
+// Run campaigns for the lease until the context is cancelled. The lease is
+// kept until Release, so an update still in flight stays protected.
+func (e *Elector) Run(ctx context.Context) {
+	defer close(e.stopped)
+	e.campaign(ctx)
+
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			e.campaign(ctx)
+		}
+	}
+}
+
+// Release waits for Run to return and gives up the lease. Call it once no
+// update can run anymore.
+func (e *Elector) Release() {
+	<-e.stopped
+	if !e.leading.Load() {
+		return
+	}
+	if err := e.lock.Release(); err != nil {
+		log.Println("Error releasing leader lease: ", err)
+	}
+	e.setLeading(false)
+}
+
+func (e *Elector) campaign(ctx context.Context) {
+	leading, err := e.lock.TryAcquire(ctx)
+	if err != nil {
+		// without a confirmed lease we must assume someone else may hold it
+		log.Println("Error acquiring leader lease: ", err)
+		leading = false
+	}
+	e.setLeading(leading)
+}
+
+func (e *Elector) setLeading(leading bool) {
+	if e.leading.Swap(leading) == leading {
+		return
+	}
+
+	if leading {
+		log.Println("Became leader as", e.ID)
+	} else {
+		log.Println("Lost leadership as", e.ID)
+	}
+	if e.onChange != nil {
+		e.onChange(leading)
+	}
+}
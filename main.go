@@ -1,15 +1,24 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
-	"strings"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"tailscale-route-tiller/apply"
 	"tailscale-route-tiller/config"
+	"tailscale-route-tiller/server"
 	"tailscale-route-tiller/slack"
+	"tailscale-route-tiller/state"
 	"tailscale-route-tiller/tailscale"
 	"tailscale-route-tiller/utils"
 	"tailscale-route-tiller/worker"
+	"text/tabwriter"
+	"time"
 
 	"github.com/spf13/cobra"
 )
@@ -24,41 +33,162 @@ var (
 
 func runUpdates(testMode bool, config config.Config) {
 
-	resolvedSubnets, _, err := utils.PerformDNSLookupsWithTTL(config.Sites, config.EnableIpv6)
+	desired, err := apply.Desired(config)
 	if err != nil {
 		log.Println("Error: ", err.Error())
 		slack.PostError(err)
 		os.Exit(1)
 	}
+	resolvedSubnets := apply.Prefixes(desired)
 
-	resolvedSubnets = append(resolvedSubnets, config.Subnets...)
+	if !testMode {
+		err = apply.Routes(context.Background(), config, resolvedSubnets, state.Trigger{Kind: state.TriggerCLI, Detail: "run"})
+		if err != nil {
+			log.Println("Error: ", err.Error())
+			slack.PostError(err)
+			os.Exit(1)
+		}
+
+		slack.PostRouteUpdate(resolvedSubnets, config.TailscaleclientId)
 
-	// we might have some overlap, so let's dedupe
-	resolvedSubnets = utils.Unique(resolvedSubnets)
+	} else {
+		// test mode changes nothing, so there is nothing to tell Slack about
+		args, err := config.TailscaleCommand.Expand(resolvedSubnets)
+		if err != nil {
+			log.Println("Error: ", err.Error())
+			os.Exit(1)
+		}
+		log.Printf("In test mode, not running command: %q", args)
 
-	subnetsString := strings.Join(resolvedSubnets, ",")
+	}
+}
 
-	fullCommand := fmt.Sprintf(config.TailscaleCommand, subnetsString)
+// runPlan writes the plan to out, "-" for stdout, and a summary to the log
+func runPlan(config config.Config, out string) {
 
-	if !testMode {
-		output := utils.RunShellCommand(fullCommand, testMode)
-		log.Println(output)
-		log.Println("Trying to update Approved Subnets...")
+	plan, err := apply.NewPlan(config)
+	if err != nil {
+		log.Println("Error: ", err.Error())
+		os.Exit(1)
+	}
+
+	plan.Summary(os.Stderr)
 
-		err = tailscale.SetTailscaleApprovedSubnets(resolvedSubnets)
+	w := os.Stdout
+	if out != "-" {
+		w, err = os.Create(out)
 		if err != nil {
 			log.Println("Error: ", err.Error())
-			slack.PostError(err)
 			os.Exit(1)
 		}
+		defer w.Close()
+	}
 
-		slack.PostRouteUpdate(resolvedSubnets, config.TailscaleclientId)
+	if err := plan.Write(w); err != nil {
+		log.Println("Error: ", err.Error())
+		os.Exit(1)
+	}
+}
 
-	} else {
-		slack.PostRouteUpdate(resolvedSubnets, config.TailscaleclientId)
-		log.Println("In test mode, not running command")
+// runApplyPlan applies a saved plan, unless the device drifted since
+func runApplyPlan(config config.Config, path string) {
+
+	plan, err := apply.ReadPlan(path)
+	if err != nil {
+		log.Println("Error: ", err.Error())
+		os.Exit(1)
+	}
+
+	plan.Summary(os.Stderr)
+	if !plan.HasChanges() {
+		log.Println("Plan has no changes, nothing to apply")
+		return
+	}
+
+	err = apply.ApplyPlan(context.Background(), config, plan, state.Trigger{Kind: state.TriggerCLI, Detail: "apply " + path})
+	if err != nil {
+		log.Println("Error: ", err.Error())
+		slack.PostError(err)
+		os.Exit(1)
+	}
+
+	for _, device := range plan.Devices {
+		var added, removed []string
+		for _, change := range device.Add {
+			added = append(added, change.Prefix)
+		}
+		for _, change := range device.Remove {
+			removed = append(removed, change.Prefix)
+		}
+		slack.PostDiffUpdate(added, removed, device.Device)
+	}
+}
+
+// openState opens the state store, exiting when there is none configured
+func openState(config config.Config) state.Store {
+
+	store, err := state.Open(config.State, config.TailscaleclientId)
+	if err != nil {
+		log.Println("Error: ", err.Error())
+		os.Exit(1)
+	}
+	if store == nil {
+		log.Println("Error: State.Backend is not configured, there is no history")
+		os.Exit(1)
+	}
+	return store
+}
+
+// runHistory lists the most recent applied route sets
+func runHistory(config config.Config, limit int) {
+
+	revisions, err := openState(config).List(limit)
+	if err != nil {
+		log.Println("Error: ", err.Error())
+		os.Exit(1)
+	}
 
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "REVISION\tTIME\tTRIGGER\tROUTES\tADDED\tREMOVED")
+	for _, rev := range revisions {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d\t+%d\t-%d\n", rev.Number, rev.Time.Local().Format(time.RFC3339), rev.Trigger, len(rev.Routes), len(rev.Added), len(rev.Removed))
 	}
+	w.Flush()
+}
+
+// runShow prints a single revision as JSON
+func runShow(config config.Config, number int) {
+
+	rev, err := openState(config).Get(number)
+	if err != nil {
+		log.Println("Error: ", err.Error())
+		os.Exit(1)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(rev)
+}
+
+// runRollback applies the route set of an earlier revision again
+func runRollback(config config.Config, number int) {
+
+	rev, err := openState(config).Get(number)
+	if err != nil {
+		log.Println("Error: ", err.Error())
+		os.Exit(1)
+	}
+
+	log.Printf("Rolling back to revision %d from %s, %d routes", rev.Number, rev.Time.Local().Format(time.RFC3339), len(rev.Routes))
+	trigger := state.Trigger{Kind: state.TriggerRollback, Detail: fmt.Sprintf("to revision %d", rev.Number)}
+	err = apply.Routes(context.Background(), config, rev.Routes, trigger)
+	if err != nil {
+		log.Println("Error: ", err.Error())
+		slack.PostError(err)
+		os.Exit(1)
+	}
+
+	slack.PostRouteUpdate(rev.Routes, config.TailscaleclientId)
 }
 
 func runGetTailsScaleClientRouteSettings(config config.Config) {
@@ -122,6 +252,7 @@ func main() {
 	}
 
 	runCmd.Flags().BoolVarP(&testMode, "test", "t", false, "Run in test mode")
+	runCmd.Flags().BoolVar(&apply.Force, "force", false, "Apply even when the change trips the guard rails")
 	rootCmd.AddCommand(runCmd)
 
 	// worker Command
@@ -130,13 +261,160 @@ func main() {
 		Short: "Run in worker mode, waits for an SQS messages, then runs the tailscale command to update the routes",
 		Run: func(cmd *cobra.Command, args []string) {
 			initConfig(ConfigFile)
-			worker.Run(testMode, *config.ActiveConfig)
+
+			// stop cleanly on SIGTERM/SIGINT
+			ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+			defer stop()
+
+			worker.Run(ctx, testMode, *config.ActiveConfig)
 		},
 	}
 
 	workerCmd.Flags().BoolVarP(&testMode, "test", "t", false, "Run in test mode")
 	rootCmd.AddCommand(workerCmd)
 
+	// serve Command
+	serveCmd := &cobra.Command{
+		Use:   "serve",
+		Short: "Receive events over HTTP instead of SQS, then run the tailscale command to update the routes",
+		Run: func(cmd *cobra.Command, args []string) {
+			initConfig(ConfigFile)
+
+			// stop cleanly on SIGTERM/SIGINT
+			ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+			defer stop()
+
+			server.Run(ctx, testMode, *config.ActiveConfig)
+		},
+	}
+
+	serveCmd.Flags().BoolVarP(&testMode, "test", "t", false, "Run in test mode")
+	rootCmd.AddCommand(serveCmd)
+
+	// replay Command
+	var dnsFixture string
+
+	replayCmd := &cobra.Command{
+		Use:   "replay [file|directory|-]...",
+		Short: "Show what the worker would do with events read from files or stdin, without changing anything",
+		Run: func(cmd *cobra.Command, args []string) {
+			initConfig(ConfigFile)
+
+			if dnsFixture != "" {
+				if err := utils.LoadDNSFixture(dnsFixture); err != nil {
+					log.Fatalf("failed to load DNS fixture, %v", err)
+				}
+			}
+
+			bodies, err := worker.ReadMessages(args, os.Stdin)
+			if err != nil {
+				log.Fatalf("failed to read events, %v", err)
+			}
+
+			if err := worker.Replay(*config.ActiveConfig, bodies, os.Stdout); err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+
+	replayCmd.Flags().StringVar(&dnsFixture, "dns-fixture", "", "Answer DNS lookups from a YAML or JSON file mapping host names to addresses")
+	rootCmd.AddCommand(replayCmd)
+
+	// plan Command
+	var planOut string
+
+	planCmd := &cobra.Command{
+		Use:   "plan",
+		Short: "Compare the desired routes with the current ones and write a JSON plan",
+		Run: func(cmd *cobra.Command, args []string) {
+			initConfig(ConfigFile)
+			runPlan(*config.ActiveConfig, planOut)
+		},
+	}
+
+	planCmd.Flags().StringVarP(&planOut, "out", "o", "-", "Write the plan to this file instead of stdout")
+	rootCmd.AddCommand(planCmd)
+
+	// apply Command
+	var planFile string
+
+	applyCmd := &cobra.Command{
+		Use:   "apply",
+		Short: "Apply a plan written by the plan command, refusing if the routes changed since",
+		Run: func(cmd *cobra.Command, args []string) {
+			initConfig(ConfigFile)
+			runApplyPlan(*config.ActiveConfig, planFile)
+		},
+	}
+
+	applyCmd.Flags().StringVarP(&planFile, "plan", "p", "", "Plan file to apply")
+	applyCmd.Flags().BoolVar(&apply.Force, "force", false, "Apply even when the change trips the guard rails")
+	applyCmd.MarkFlagRequired("plan")
+	rootCmd.AddCommand(applyCmd)
+
+	// approve Command
+	approveCmd := &cobra.Command{
+		Use:   "approve <fingerprint>",
+		Short: "Approve a change that was refused by the guard rails, so its next attempt goes through",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			initConfig(ConfigFile)
+			if err := apply.Approve(config.ActiveConfig.Guard, args[0]); err != nil {
+				log.Fatal(err)
+			}
+			log.Println("Approved change ", args[0])
+		},
+	}
+	rootCmd.AddCommand(approveCmd)
+
+	// history Command
+	var historyLimit int
+
+	historyCmd := &cobra.Command{
+		Use:   "history",
+		Short: "List the route sets that were applied, with when and why",
+		Run: func(cmd *cobra.Command, args []string) {
+			initConfig(ConfigFile)
+			runHistory(*config.ActiveConfig, historyLimit)
+		},
+	}
+
+	historyCmd.Flags().IntVarP(&historyLimit, "limit", "n", 20, "Show at most this many revisions, 0 for all")
+	rootCmd.AddCommand(historyCmd)
+
+	// show Command
+	showCmd := &cobra.Command{
+		Use:   "show <revision>",
+		Short: "Show the routes, trigger and diff of a revision",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			number, err := strconv.Atoi(args[0])
+			if err != nil {
+				log.Fatalf("invalid revision %q", args[0])
+			}
+			initConfig(ConfigFile)
+			runShow(*config.ActiveConfig, number)
+		},
+	}
+	rootCmd.AddCommand(showCmd)
+
+	// rollback Command
+	var rollbackTo int
+
+	rollbackCmd := &cobra.Command{
+		Use:   "rollback",
+		Short: "Apply the route set of an earlier revision again",
+		Run: func(cmd *cobra.Command, args []string) {
+			initConfig(ConfigFile)
+			runRollback(*config.ActiveConfig, rollbackTo)
+		},
+	}
+
+	rollbackCmd.Flags().IntVar(&rollbackTo, "to", 0, "Revision to roll back to")
+	rollbackCmd.Flags().BoolVar(&apply.Force, "force", false, "Apply even when the change trips the guard rails")
+	rollbackCmd.MarkFlagRequired("to")
+	rootCmd.AddCommand(rollbackCmd)
+
 	// Get Client Routes Command
 	getClientRoutes := &cobra.Command{
 		Use:   "get-client-routes",
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"tailscale-route-tiller/config"
+	"time"
+)
+
+// SignatureHeader carries the HMAC-SHA256 of "<timestamp>.<body>"
+const SignatureHeader = "X-Signature-256"
+
+// TimestampHeader carries the unix time the request was signed at
+const TimestampHeader = "X-Signature-Timestamp"
+
+var errUnauthorized = errors.New("missing or invalid credentials")
+
+// authenticator accepts either a bearer token or a body signature
+type authenticator struct {
+	tokens [][]byte
+	secret []byte
+}
+
+func newAuthenticator(cfg config.Server) (*authenticator, error) {
+	a := &authenticator{}
+	for _, token := range cfg.BearerTokens {
+		if token != "" {
+			a.tokens = append(a.tokens, []byte(token))
+		}
+	}
+	if cfg.HMACSecret != "" {
+		a.secret = []byte(cfg.HMACSecret)
+	}
+
+	// an open endpoint would let anyone trigger route updates
+	if len(a.tokens) == 0 && a.secret == nil {
+		return nil, errors.New("Server needs BearerTokens or an HMACSecret")
+	}
+	return a, nil
+}
+
+// check verifies the request against the body that was read from it
+func (a *authenticator) check(r *http.Request, body []byte) error {
+	if auth := r.Header.Get("Authorization"); auth != "" && len(a.tokens) > 0 {
+		token, ok := strings.CutPrefix(auth, "Bearer ")
+		if ok {
+			for _, accepted := range a.tokens {
+				if subtle.ConstantTimeCompare([]byte(token), accepted) == 1 {
+					return nil
+				}
+			}
+		}
+	}
+
+	if signature := r.Header.Get(SignatureHeader); signature != "" && a.secret != nil {
+		return verifySignature(a.secret, signature, r.Header.Get(TimestampHeader), body, time.Now())
+	}
+
+	return errUnauthorized
+}
+
+// verifySignature checks a "sha256=<hex>" signature of "<timestamp>.<body>".
+// The timestamp must be recent, so a captured request can't be replayed later.
+func verifySignature(secret []byte, signature string, timestamp string, body []byte, now time.Time) error {
+	digest, ok := strings.CutPrefix(signature, "sha256=")
+	if !ok {
+		return errUnauthorized
+	}
+	got, err := hex.DecodeString(digest)
+	if err != nil {
+		return errUnauthorized
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("missing or malformed %s", TimestampHeader)
+	}
+	age := now.Sub(time.Unix(seconds, 0))
+	if age > signatureTolerance || age < -signatureTolerance {
+		return fmt.Errorf("signature timestamp is %s off", age.Round(time.Second))
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return errUnauthorized
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func sign(secret string, timestamp string, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "." + body))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifySignature(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	ts := strconv.FormatInt(now.Unix(), 10)
+	skewed := strconv.FormatInt(now.Add(-2*time.Minute).Unix(), 10)
+	old := strconv.FormatInt(now.Add(-10*time.Minute).Unix(), 10)
+	body := `{"reason": "test"}`
+
+	tests := []struct {
+		name      string
+		signature string
+		timestamp string
+		body      string
+		ok        bool
+	}{
+		{"good", sign("secret", ts, body), ts, body, true},
+		{"slightly skewed", sign("secret", skewed, body), skewed, body, true},
+		{"stale", sign("secret", old, body), old, body, false},
+		{"tampered body", sign("secret", ts, body), ts, `{"reason": "other"}`, false},
+		{"tampered timestamp", sign("secret", old, body), ts, body, false},
+		{"wrong secret", sign("other", ts, body), ts, body, false},
+		{"missing timestamp", sign("secret", ts, body), "", body, false},
+		{"missing prefix", sign("secret", ts, body)[len("sha256="):], ts, body, false},
+		{"not hex", "sha256=zz", ts, body, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifySignature([]byte("secret"), tt.signature, tt.timestamp, []byte(tt.body), now)
+			if (err == nil) != tt.ok {
+				t.Errorf("verifySignature() = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,284 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"tailscale-route-tiller/config"
+	"tailscale-route-tiller/slack"
+	"tailscale-route-tiller/state"
+	"tailscale-route-tiller/worker"
+	"time"
+)
+
+// maxBodySize caps the size of a posted event
+const maxBodySize = 1 << 20
+
+// job is one accepted request waiting for the pipeline
+type job struct {
+	events    []worker.Event
+	reconcile string // reason for a full reconcile, empty for events only
+}
+
+type server struct {
+	config        config.Config
+	pipeline      *worker.Pipeline
+	auth          *authenticator
+	tailnetSecret []byte
+	limiter       *limiter
+	queue         chan job
+}
+
+// Run serves the webhook endpoints until the context is cancelled
+func Run(ctx context.Context, testMode bool, config config.Config) {
+	cfg := config.Server
+
+	listen := cfg.Listen
+	if listen == "" {
+		listen = ":8080"
+	}
+	rate := cfg.RateLimit
+	if rate <= 0 {
+		rate = 5
+	}
+	burst := cfg.Burst
+	if burst <= 0 {
+		burst = 20
+	}
+	queueSize := cfg.QueueSize
+	if queueSize <= 0 {
+		queueSize = 100
+	}
+
+	// the event endpoints need their own credentials, tailnet webhooks are signed
+	auth, err := newAuthenticator(cfg)
+	if err != nil {
+		if cfg.TailscaleWebhookSecret == "" {
+			log.Fatal(err)
+		}
+		log.Println("Only serving Tailscale webhooks: ", err.Error())
+	}
+
+	pipeline, err := worker.NewPipeline(testMode, config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer pipeline.Close()
+
+	if err := pipeline.Start(ctx); err != nil {
+		log.Fatal(err)
+	}
+
+	pipeline.Source = state.TriggerHTTP
+
+	s := &server{
+		config:   config,
+		pipeline: pipeline,
+		auth:     auth,
+		limiter:  newLimiter(rate, burst),
+		queue:    make(chan job, queueSize),
+	}
+
+	mux := http.NewServeMux()
+	if auth != nil {
+		mux.HandleFunc("/events", s.handleEvents)
+		mux.HandleFunc("/reconcile", s.handleReconcile)
+	}
+	if cfg.TailscaleWebhookSecret != "" {
+		s.tailnetSecret = []byte(cfg.TailscaleWebhookSecret)
+		mux.HandleFunc("/tailscale", s.handleTailnet)
+	}
+	mux.HandleFunc("/healthz", s.handleHealth)
+
+	httpServer := &http.Server{
+		Addr:              listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.process(ctx)
+		close(done)
+	}()
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		httpServer.Shutdown(shutdownCtx)
+	}()
+
+	log.Printf("Listening for events on %s", listen)
+	err = httpServer.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatalf("failed to serve, %v", err)
+	}
+
+	<-done
+	log.Println("Server stopped")
+}
+
+// process feeds queued jobs into the pipeline one batch at a time
+func (s *server) process(ctx context.Context) {
+	for {
+		var first job
+		select {
+		case <-ctx.Done():
+			if n := len(s.queue); n > 0 {
+				log.Printf("Shutting down, dropping %d queued requests", n)
+			}
+			return
+		case first = <-s.queue:
+		}
+
+		// everything that queued up meanwhile goes into the same update
+		jobs := []job{first}
+	drain:
+		for {
+			select {
+			case next := <-s.queue:
+				jobs = append(jobs, next)
+			default:
+				break drain
+			}
+		}
+
+		var events []worker.Event
+		reason := ""
+		for _, j := range jobs {
+			events = append(events, j.events...)
+			if j.reconcile != "" && reason == "" {
+				reason = j.reconcile
+			}
+		}
+
+		if len(events) > 0 {
+			err := s.pipeline.Handle(ctx, events)
+			if errors.Is(err, worker.ErrAbandoned) {
+				log.Printf("Shutting down, dropping %d events: %v", len(events), worker.EventIDs(events))
+				return
+			}
+			if err != nil {
+				// the sender already got a 202, so this is the last word on these events
+				ids := worker.EventIDs(events)
+				log.Printf("Update failed, dropping %d events %v: %v", len(events), ids, err)
+				slack.PostError(fmt.Errorf("webhook events %s were not applied: %w", strings.Join(ids, ", "), err))
+			}
+		}
+
+		if reason != "" {
+			if err := s.pipeline.Reconcile(reason); err != nil {
+				log.Println("Reconcile failed: ", err.Error())
+			}
+		}
+	}
+}
+
+// accept reads a request, authenticates it with check and applies the rate
+// limit, writing the error response itself
+func (s *server) accept(w http.ResponseWriter, r *http.Request, check func(*http.Request, []byte) error) ([]byte, bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+		return nil, false
+	}
+
+	if err := check(r, body); err != nil {
+		log.Printf("Rejected request from %s: %v", r.RemoteAddr, err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return nil, false
+	}
+
+	// only authenticated callers count, so strangers can't use up the budget
+	if !s.limiter.allow() {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+		return nil, false
+	}
+
+	return body, true
+}
+
+// leading writes a 503 on followers, which would drop the work, so the
+// caller retries against the leader
+func (s *server) leading(w http.ResponseWriter) bool {
+	if !s.pipeline.IsLeader() {
+		http.Error(w, "not the leader", http.StatusServiceUnavailable)
+		return false
+	}
+	return true
+}
+
+// enqueue hands a job to the processing goroutine without blocking
+func (s *server) enqueue(w http.ResponseWriter, j job) {
+	select {
+	case s.queue <- j:
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		w.Header().Set("Retry-After", "10")
+		http.Error(w, "queue full", http.StatusServiceUnavailable)
+	}
+}
+
+// handleEvents accepts CloudTrail/EventBridge events, bare or in an SNS or S3 envelope
+func (s *server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	body, ok := s.accept(w, r, s.auth.check)
+	if !ok || !s.leading(w) {
+		return
+	}
+
+	events, err := worker.ParseEvents(body, s.pipeline.Verifier)
+	if err != nil {
+		http.Error(w, "unparseable event: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(events) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	s.enqueue(w, job{events: events})
+}
+
+// handleReconcile queues a full reconcile, with an optional {"reason": "..."} body
+func (s *server) handleReconcile(w http.ResponseWriter, r *http.Request) {
+	body, ok := s.accept(w, r, s.auth.check)
+	if !ok || !s.leading(w) {
+		return
+	}
+
+	request := struct {
+		Reason string `json:"reason"`
+	}{}
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &request); err != nil {
+			http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if request.Reason == "" {
+		request.Reason = "Reconcile requested over HTTP"
+	}
+
+	s.enqueue(w, job{reconcile: request.Reason})
+}
+
+// handleHealth reports whether the server is up and leading
+func (s *server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"leader": s.pipeline.IsLeader(),
+		"queued": len(s.queue),
+	})
+}
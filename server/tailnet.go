@@ -0,0 +1,164 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"tailscale-route-tiller/config"
+	"tailscale-route-tiller/slack"
+	"time"
+)
+
+// TailscaleSignatureHeader carries the signature of Tailscale webhooks
+const TailscaleSignatureHeader = "Tailscale-Webhook-Signature"
+
+// signatureTolerance is how old a signed webhook may be, to stop replays
+const signatureTolerance = 5 * time.Minute
+
+// tailnetEvent is one entry of a Tailscale webhook delivery
+type tailnetEvent struct {
+	Timestamp string `json:"timestamp"`
+	Version   int    `json:"version"`
+	Type      string `json:"type"`
+	Tailnet   string `json:"tailnet"`
+	Message   string `json:"message"`
+	Data      struct {
+		NodeID     string `json:"nodeID"`
+		DeviceName string `json:"deviceName"`
+		URL        string `json:"url"`
+	} `json:"data"`
+}
+
+// events about our router that need attention, and those that mean it re-registered
+var tailnetAlerts = map[string]bool{
+	"subnetIPForwardingNotEnabled": true,
+	"nodeKeyExpiringInOneDay":      true,
+	"nodeKeyExpired":               true,
+}
+var tailnetReconciles = map[string]bool{
+	"nodeCreated":  true,
+	"nodeApproved": true,
+}
+
+// verifyTailscaleSignature checks a "t=<unix time>,v1=<hex>" header, where v1
+// is the HMAC-SHA256 of "<t>.<body>"
+func verifyTailscaleSignature(secret []byte, header string, body []byte, now time.Time) error {
+	var timestamp string
+	var signatures []string
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signatures = append(signatures, value)
+		}
+	}
+	if timestamp == "" || len(signatures) == 0 {
+		return errors.New("malformed signature header")
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("malformed signature timestamp")
+	}
+	age := now.Sub(time.Unix(seconds, 0))
+	if age > signatureTolerance || age < -signatureTolerance {
+		return fmt.Errorf("signature timestamp is %s off", age.Round(time.Second))
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	expected := mac.Sum(nil)
+
+	for _, signature := range signatures {
+		got, err := hex.DecodeString(signature)
+		if err == nil && hmac.Equal(got, expected) {
+			return nil
+		}
+	}
+	return errUnauthorized
+}
+
+// ourNode reports whether a tailnet event concerns the router we manage
+func ourNode(cfg config.Config, event tailnetEvent) bool {
+	if event.Data.NodeID != "" && event.Data.NodeID == cfg.TailscaleclientId {
+		return true
+	}
+	name := cfg.Server.TailscaleDeviceName
+	return name != "" && (event.Data.DeviceName == name || strings.HasPrefix(event.Data.DeviceName, name+"."))
+}
+
+// staleClientID reports whether the event matched our router by name only,
+// while naming another node ID. The router then registered as a new node, and
+// TailscaleclientId points at the old one.
+func staleClientID(cfg config.Config, event tailnetEvent) bool {
+	return event.Data.NodeID != "" && event.Data.NodeID != cfg.TailscaleclientId
+}
+
+// handleTailnet receives Tailscale webhooks, alerting when our router needs
+// attention and reconciling when it registers again
+func (s *server) handleTailnet(w http.ResponseWriter, r *http.Request) {
+	body, ok := s.accept(w, r, func(r *http.Request, body []byte) error {
+		return verifyTailscaleSignature(s.tailnetSecret, r.Header.Get(TailscaleSignatureHeader), body, time.Now())
+	})
+	if !ok {
+		return
+	}
+
+	var events []tailnetEvent
+	if err := json.Unmarshal(body, &events); err != nil {
+		http.Error(w, "invalid webhook: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	reason := ""
+	var alerts []tailnetEvent
+	for _, event := range events {
+		if !ourNode(s.config, event) {
+			log.Printf("Ignoring tailnet event %s for %s", event.Type, event.Data.DeviceName)
+			continue
+		}
+		log.Printf("Tailnet event %s for our router %s: %s", event.Type, event.Data.DeviceName, event.Message)
+
+		switch {
+		case tailnetAlerts[event.Type]:
+			alerts = append(alerts, event)
+		case tailnetReconciles[event.Type] && staleClientID(s.config, event):
+			// reconciling would only update the old node, so ask for the config to be fixed
+			event.Message = fmt.Sprintf("%s is now node %s, but TailscaleclientId is still %s. Update TailscaleclientId, routes are not reconciled until then.",
+				event.Data.DeviceName, event.Data.NodeID, s.config.TailscaleclientId)
+			alerts = append(alerts, event)
+		case tailnetReconciles[event.Type]:
+			reason = "Tailnet event " + event.Type + " for " + event.Data.DeviceName
+		}
+	}
+
+	// alerts don't change routes, so any instance posts them. Only a reconcile
+	// needs the leader, and then the retry posts the alerts too.
+	if reason != "" && !s.leading(w) {
+		return
+	}
+
+	for _, event := range alerts {
+		text := event.Message
+		if event.Data.URL != "" {
+			text += "\n" + event.Data.URL
+		}
+		slack.PostTailnetAlert(event.Type, text, s.config.TailscaleclientId)
+	}
+
+	if reason == "" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	s.enqueue(w, job{reconcile: reason})
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"tailscale-route-tiller/config"
+	"testing"
+	"time"
+)
+
+func tailscaleSignature(secret string, timestamp string, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "." + body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifyTailscaleSignature(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	ts := strconv.FormatInt(now.Unix(), 10)
+	stale := strconv.FormatInt(now.Add(-6*time.Minute).Unix(), 10)
+	future := strconv.FormatInt(now.Add(6*time.Minute).Unix(), 10)
+	body := `[{"type":"nodeKeyExpired","data":{"nodeID":"n1"}}]`
+	good := tailscaleSignature("secret", ts, body)
+
+	tests := []struct {
+		name   string
+		header string
+		body   string
+		ok     bool
+	}{
+		{"good", "t=" + ts + ",v1=" + good, body, true},
+		{"good with spaces", "t=" + ts + ", v1=" + good, body, true},
+		{"one of several signatures", "t=" + ts + ",v1=00,v1=" + good, body, true},
+		{"stale", "t=" + stale + ",v1=" + tailscaleSignature("secret", stale, body), body, false},
+		{"from the future", "t=" + future + ",v1=" + tailscaleSignature("secret", future, body), body, false},
+		{"tampered body", "t=" + ts + ",v1=" + good, `[{"type":"nodeCreated","data":{"nodeID":"n1"}}]`, false},
+		{"tampered timestamp", "t=" + strconv.FormatInt(now.Unix()-1, 10) + ",v1=" + good, body, false},
+		{"wrong secret", "t=" + ts + ",v1=" + tailscaleSignature("other", ts, body), body, false},
+		{"missing timestamp", "v1=" + good, body, false},
+		{"missing signature", "t=" + ts, body, false},
+		{"malformed timestamp", "t=soon,v1=" + good, body, false},
+		{"not hex", "t=" + ts + ",v1=zz", body, false},
+		{"empty header", "", body, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyTailscaleSignature([]byte("secret"), tt.header, []byte(tt.body), now)
+			if (err == nil) != tt.ok {
+				t.Errorf("verifyTailscaleSignature() = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestOurNode(t *testing.T) {
+	cfg := config.Config{TailscaleclientId: "n1"}
+	cfg.Server.TailscaleDeviceName = "router"
+
+	tests := []struct {
+		name       string
+		nodeID     string
+		deviceName string
+		ours       bool
+		stale      bool
+	}{
+		{"node ID", "n1", "other", true, false},
+		{"device name", "", "router", true, false},
+		{"device name with domain", "", "router.tail1234.ts.net", true, false},
+		{"device name with the same node ID", "n1", "router.tail1234.ts.net", true, false},
+		{"device name with a new node ID", "n2", "router.tail1234.ts.net", true, true},
+		{"other device", "n2", "routers.tail1234.ts.net", false, true},
+		{"no match", "", "laptop", false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var event tailnetEvent
+			event.Data.NodeID = tt.nodeID
+			event.Data.DeviceName = tt.deviceName
+			if got := ourNode(cfg, event); got != tt.ours {
+				t.Errorf("ourNode() = %v, want %v", got, tt.ours)
+			}
+			if got := staleClientID(cfg, event); got != tt.stale {
+				t.Errorf("staleClientID() = %v, want %v", got, tt.stale)
+			}
+		})
+	}
+}
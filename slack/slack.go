@@ -3,6 +3,7 @@ package slack
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	"strings"
@@ -190,3 +191,227 @@ func PostDiffUpdate(added []string, removed []string, nodeID string) {
 
 	sendit(payload)
 }
+
+func PostDriftFixed(added []string, removed []string, nodeID string) {
+
+	if !Enabled {
+		return
+	}
+
+	message := SlackMessage{
+		Blocks: []SlackBlock{
+			{
+				Type: "section",
+				Text: struct {
+					Type string `json:"type"`
+					Text string `json:"text"`
+				}{
+					Type: "mrkdwn",
+					Text: "*Periodic reconcile fixed route drift for Node ID:* " + nodeID,
+				},
+			},
+			{
+				Type: "section",
+				Text: struct {
+					Type string `json:"type"`
+					Text string `json:"text"`
+				}{
+					Type: "mrkdwn",
+					Text: "*Added:*\n" + strings.Join(added, ", "),
+				},
+			},
+			{
+				Type: "section",
+				Text: struct {
+					Type string `json:"type"`
+					Text string `json:"text"`
+				}{
+					Type: "mrkdwn",
+					Text: "*Removed:*\n" + strings.Join(removed, ", "),
+				},
+			},
+		},
+	}
+
+	payload, err := json.Marshal(message)
+	if err != nil {
+		log.Fatal("Error marshaling Slack message:", err)
+	}
+
+	sendit(payload)
+}
+
+func PostBatchSummary(descriptions []string, note string, nodeID string) {
+
+	if !Enabled {
+		return
+	}
+
+	// count repeated descriptions so a burst of events stays readable
+	counts := map[string]int{}
+	var order []string
+	for _, description := range descriptions {
+		if counts[description] == 0 {
+			order = append(order, description)
+		}
+		counts[description]++
+	}
+
+	var lines []string
+	for _, description := range order {
+		lines = append(lines, fmt.Sprintf("%s (x%d)", description, counts[description]))
+	}
+
+	if note != "" {
+		lines = append(lines, "_"+note+"_")
+	}
+
+	message := SlackMessage{
+		Blocks: []SlackBlock{
+			{
+				Type: "section",
+				Text: struct {
+					Type string `json:"type"`
+					Text string `json:"text"`
+				}{
+					Type: "mrkdwn",
+					Text: "*Updating Advertised routes for Node ID:* " + nodeID,
+				},
+			},
+			{
+				Type: "section",
+				Text: struct {
+					Type string `json:"type"`
+					Text string `json:"text"`
+				}{
+					Type: "mrkdwn",
+					Text: fmt.Sprintf("*Events:* %d\n", len(descriptions)) + strings.Join(lines, "\n"),
+				},
+			},
+		},
+	}
+
+	payload, err := json.Marshal(message)
+	if err != nil {
+		log.Fatal("Error marshaling Slack message:", err)
+	}
+
+	sendit(payload)
+}
+
+func PostLeadershipChange(workerID string, leading bool, nodeID string) {
+
+	if !Enabled {
+		return
+	}
+
+	text := "*Worker " + workerID + " is now the leader for Node ID:* " + nodeID
+	if !leading {
+		text = "*Worker " + workerID + " is no longer the leader for Node ID:* " + nodeID
+	}
+
+	message := SlackMessage{
+		Blocks: []SlackBlock{
+			{
+				Type: "section",
+				Text: struct {
+					Type string `json:"type"`
+					Text string `json:"text"`
+				}{
+					Type: "mrkdwn",
+					Text: text,
+				},
+			},
+		},
+	}
+
+	payload, err := json.Marshal(message)
+	if err != nil {
+		log.Fatal("Error marshaling Slack message:", err)
+	}
+
+	sendit(payload)
+}
+
+func PostTailnetAlert(eventType string, text string, nodeID string) {
+
+	if !Enabled {
+		return
+	}
+
+	message := SlackMessage{
+		Blocks: []SlackBlock{
+			{
+				Type: "section",
+				Text: struct {
+					Type string `json:"type"`
+					Text string `json:"text"`
+				}{
+					Type: "mrkdwn",
+					Text: ":warning: *Tailnet alert " + eventType + " for Node ID:* " + nodeID,
+				},
+			},
+			{
+				Type: "section",
+				Text: struct {
+					Type string `json:"type"`
+					Text string `json:"text"`
+				}{
+					Type: "mrkdwn",
+					Text: text,
+				},
+			},
+		},
+	}
+
+	payload, err := json.Marshal(message)
+	if err != nil {
+		log.Fatal("Error marshaling Slack message:", err)
+	}
+
+	sendit(payload)
+}
+
+func PostRollback(cause error, rollbackErr error, nodeID string) {
+
+	if !Enabled {
+		return
+	}
+
+	text := ":rewind: *Rolled back the routes of Node ID:* " + nodeID + "\nThe previous advertised and approved routes are restored."
+	if rollbackErr != nil {
+		text = ":rotating_light: *Rollback failed for Node ID:* " + nodeID + "\n" + rollbackErr.Error() + "\nThe device may advertise routes that are not approved."
+	}
+
+	message := SlackMessage{
+		Blocks: []SlackBlock{
+			{
+				Type: "section",
+				Text: struct {
+					Type string `json:"type"`
+					Text string `json:"text"`
+				}{
+					Type: "mrkdwn",
+					Text: text,
+				},
+			},
+			{
+				Type: "section",
+				Text: struct {
+					Type string `json:"type"`
+					Text string `json:"text"`
+				}{
+					Type: "mrkdwn",
+					Text: "_Apply failed: " + cause.Error() + "_",
+				},
+			},
+		},
+	}
+
+	payload, err := json.Marshal(message)
+	if err != nil {
+		log.Fatal("Error marshaling Slack message:", err)
+	}
+
+	sendit(payload)
+}
@@ -0,0 +1,218 @@
+package sources
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"tailscale-route-tiller/config"
+	"time"
+)
+
+const defaultConsulAddress = "http://127.0.0.1:8500"
+const defaultConsulWait = 300
+
+// consulPollInterval paces servers that don't answer with X-Consul-Index,
+// which can't block
+const consulPollInterval = 10 * time.Second
+
+type consulServiceEntry struct {
+	Node struct {
+		Address string `json:"Address"`
+	} `json:"Node"`
+	Service struct {
+		Address string `json:"Address"`
+	} `json:"Service"`
+}
+
+type consulState struct {
+	index     uint64
+	addresses []string
+}
+
+var consulStates = map[string]*consulState{}
+var consulLock sync.Mutex
+
+// consulKey identifies a watched service. Sources that differ in address or
+// tags see different instances, so they are kept apart.
+func consulKey(source config.ConsulSource, service string) string {
+	key := "consul:" + source.Datacenter + "/" + service
+	if len(source.Tags) > 0 {
+		tags := append([]string{}, source.Tags...)
+		sort.Strings(tags)
+		key += "[" + strings.Join(tags, ",") + "]"
+	}
+	if source.Address != "" {
+		key += "@" + strings.TrimSuffix(source.Address, "/")
+	}
+	return key
+}
+
+// queryConsul asks for the healthy instances of a service. A non-zero index
+// turns the request into a blocking query that returns once the index moves
+// past it or the wait time runs out.
+func queryConsul(ctx context.Context, source config.ConsulSource, service string, index uint64) ([]string, uint64, error) {
+	address := source.Address
+	if address == "" {
+		address = defaultConsulAddress
+	}
+	wait := source.WaitTime
+	if wait <= 0 {
+		wait = defaultConsulWait
+	}
+
+	query := url.Values{}
+	query.Set("passing", "1")
+	for _, tag := range source.Tags {
+		query.Add("tag", tag)
+	}
+	if source.Datacenter != "" {
+		query.Set("dc", source.Datacenter)
+	}
+	if index > 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", strconv.Itoa(wait)+"s")
+	}
+
+	endpoint := strings.TrimSuffix(address, "/") + "/v1/health/service/" + url.PathEscape(service) + "?" + query.Encode()
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if source.Token != "" {
+		req.Header.Set("X-Consul-Token", source.Token)
+	}
+
+	// blocking queries may take up to wait plus a little jitter on the server side
+	client := &http.Client{Timeout: time.Duration(wait)*time.Second + time.Minute}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var entries []consulServiceEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, 0, err
+	}
+
+	newIndex, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+
+	var addresses []string
+	for _, entry := range entries {
+		address := entry.Service.Address
+		if address == "" {
+			address = entry.Node.Address
+		}
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+
+	return addresses, newIndex, nil
+}
+
+func readConsulSource(source config.ConsulSource, enableIpv6 bool) ([]Route, error) {
+	var routes []Route
+
+	for _, service := range source.Services {
+		key := consulKey(source, service)
+
+		consulLock.Lock()
+		state, ok := consulStates[key]
+		consulLock.Unlock()
+
+		var addresses []string
+		if ok {
+			addresses = state.addresses
+		} else {
+			var err error
+			addresses, _, err = queryConsul(context.Background(), source, service, 0)
+			if err != nil {
+				return nil, fmt.Errorf("service %q: %v", service, err)
+			}
+		}
+
+		for _, address := range addresses {
+			prefix, isIpv6, err := NormalizePrefix(address)
+			if err != nil {
+				log.Println("Skipping non-IP Consul address", key, address)
+				continue
+			}
+			if isIpv6 && !enableIpv6 {
+				logSkipped(key, prefix)
+				continue
+			}
+			routes = append(routes, Route{Prefix: prefix, Source: key})
+		}
+	}
+
+	return routes, nil
+}
+
+// watchConsul follows a service with blocking queries and reports every
+// change to its set of healthy addresses
+func watchConsul(ctx context.Context, source config.ConsulSource, service string, changes chan<- string) {
+	key := consulKey(source, service)
+	var index uint64
+	backoff := time.Second
+
+	for {
+		addresses, newIndex, err := queryConsul(ctx, source, service, index)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Println("Error watching Consul service: ", key, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			if backoff < time.Minute {
+				backoff *= 2
+			}
+			continue
+		}
+		backoff = time.Second
+
+		// the index can go backwards after a Consul restart, so start over
+		polling := newIndex == 0
+		if newIndex < index || polling {
+			// never 0 again, that would turn the next query into a non-blocking one
+			newIndex = 1
+		}
+		index = newIndex
+
+		consulLock.Lock()
+		state, ok := consulStates[key]
+		changed := ok && strings.Join(state.addresses, ",") != strings.Join(addresses, ",")
+		consulStates[key] = &consulState{index: index, addresses: addresses}
+		consulLock.Unlock()
+
+		if changed {
+			log.Println("Consul service changed: ", key, addresses)
+			if !notify(ctx, changes, key) {
+				return
+			}
+		}
+
+		// without an index the server answers straight away, don't spin on it
+		if polling {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(consulPollInterval):
+			}
+		}
+	}
+}
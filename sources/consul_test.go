@@ -0,0 +1,198 @@
+package sources
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"tailscale-route-tiller/config"
+	"testing"
+	"time"
+)
+
+// consulReply is what the fake Consul answers to one query
+type consulReply struct {
+	index     uint64
+	addresses []string
+}
+
+// fakeConsul answers queries from a script and records the index of each.
+// Once the script runs out it blocks like an unchanged service would.
+type fakeConsul struct {
+	lock    sync.Mutex
+	script  []consulReply
+	indexes []string
+	waits   []string
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	f.indexes = append(f.indexes, r.URL.Query().Get("index"))
+	f.waits = append(f.waits, r.URL.Query().Get("wait"))
+	if len(f.script) == 0 {
+		f.lock.Unlock()
+		<-r.Context().Done()
+		return
+	}
+	reply := f.script[0]
+	f.script = f.script[1:]
+	f.lock.Unlock()
+
+	w.Header().Set("X-Consul-Index", fmt.Sprint(reply.index))
+	fmt.Fprint(w, "[")
+	for i, address := range reply.addresses {
+		if i > 0 {
+			fmt.Fprint(w, ",")
+		}
+		fmt.Fprintf(w, `{"Node":{"Address":"192.168.0.1"},"Service":{"Address":%q}}`, address)
+	}
+	fmt.Fprint(w, "]")
+}
+
+func (f *fakeConsul) recorded() ([]string, []string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]string{}, f.indexes...), append([]string{}, f.waits...)
+}
+
+func TestWatchConsul(t *testing.T) {
+	fake := &fakeConsul{script: []consulReply{
+		{5, []string{"10.0.0.1"}},
+		{7, []string{"10.0.0.1", "10.0.0.2"}}, // a new instance
+		{8, []string{"10.0.0.2", "10.0.0.1"}}, // same instances, other order
+		{3, []string{"10.0.0.1", "10.0.0.2"}}, // Consul restarted, the index went back
+		{4, []string{"10.0.0.2"}},             // an instance went away
+	}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	source := config.ConsulSource{Address: server.URL, WaitTime: 30}
+	key := consulKey(source, "web")
+	defer func() {
+		consulLock.Lock()
+		delete(consulStates, key)
+		consulLock.Unlock()
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	changes := make(chan string)
+	done := make(chan struct{})
+	go func() {
+		watchConsul(ctx, source, "web", changes)
+		close(done)
+	}()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case changed := <-changes:
+			if changed != key {
+				t.Errorf("change reported for %q, want %q", changed, key)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("change %d was not reported", i+1)
+		}
+	}
+
+	// wait for the watcher to block on the next query
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		indexes, _ := fake.recorded()
+		if len(indexes) == 6 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case changed := <-changes:
+		t.Errorf("unexpected change for %q", changed)
+	default:
+	}
+
+	indexes, waits := fake.recorded()
+	if want := []string{"", "5", "7", "8", "1", "4"}; !reflect.DeepEqual(indexes, want) {
+		t.Errorf("queried with indexes %q, want %q", indexes, want)
+	}
+	if want := []string{"", "30s", "30s", "30s", "30s", "30s"}; !reflect.DeepEqual(waits, want) {
+		t.Errorf("queried with waits %q, want %q", waits, want)
+	}
+
+	consulLock.Lock()
+	state := consulStates[key]
+	consulLock.Unlock()
+	if state == nil || !reflect.DeepEqual(state.addresses, []string{"10.0.0.2"}) || state.index != 4 {
+		t.Errorf("cached state = %+v, want 10.0.0.2 at index 4", state)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("watchConsul did not return after the context was cancelled")
+	}
+}
+
+func TestWatchConsulStopsWithoutReader(t *testing.T) {
+	fake := &fakeConsul{script: []consulReply{
+		{5, []string{"10.0.0.1"}},
+		{6, []string{"10.0.0.2"}},
+	}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	source := config.ConsulSource{Address: server.URL}
+	key := consulKey(source, "api")
+	defer func() {
+		consulLock.Lock()
+		delete(consulStates, key)
+		consulLock.Unlock()
+	}()
+
+	// nobody reads the changes, as after the worker stopped
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		watchConsul(ctx, source, "api", make(chan string))
+		close(done)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		indexes, _ := fake.recorded()
+		if len(indexes) == 2 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("watchConsul stayed blocked on sending a change")
+	}
+}
+
+func TestWatchConsulStopsDuringBackoff(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no leader", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		watchConsul(ctx, config.ConsulSource{Address: server.URL}, "down", make(chan string))
+		close(done)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("watchConsul kept sleeping after the context was cancelled")
+	}
+}
@@ -0,0 +1,128 @@
+package sources
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"tailscale-route-tiller/config"
+	"tailscale-route-tiller/utils"
+	"time"
+)
+
+// ProtocolVersion is the version of the exec plugin protocol
+const ProtocolVersion = "route-tiller.plugin/v1"
+
+const defaultExecTimeout = 30
+
+// ExecRequest is written to the plugin's stdin
+type ExecRequest struct {
+	Version    string `json:"version"`
+	Source     string `json:"source"`
+	EnableIpv6 bool   `json:"enableIpv6"`
+}
+
+// ExecResponse is read from the plugin's stdout
+type ExecResponse struct {
+	Version  string       `json:"version"`
+	Prefixes []ExecPrefix `json:"prefixes"`
+}
+
+// ExecPrefix is a single route returned by a plugin
+type ExecPrefix struct {
+	Prefix string            `json:"prefix"`
+	TTL    int               `json:"ttl"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+func runExecSource(source config.ExecSource, enableIpv6 bool) ([]Route, error) {
+	timeout := source.Timeout
+	if timeout <= 0 {
+		timeout = defaultExecTimeout
+	}
+
+	request, err := json.Marshal(ExecRequest{
+		Version:    ProtocolVersion,
+		Source:     source.Name,
+		EnableIpv6: enableIpv6,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// RunCommand also stops waiting for children that keep stdout open
+	args := append([]string{source.Command}, source.Args...)
+	stdout, _, err := utils.RunCommand(context.Background(), args, utils.CommandOptions{
+		Timeout: time.Duration(timeout) * time.Second,
+		Stdin:   request,
+	})
+	var commandErr *utils.CommandError
+	if errors.As(err, &commandErr) && commandErr.TimedOut {
+		return nil, fmt.Errorf("plugin timed out after %ds", timeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("plugin failed: %v", err)
+	}
+
+	return parseExecResponse(source.Name, []byte(stdout), enableIpv6)
+}
+
+// checkExecNames makes sure every exec source has its own name, which keys
+// its cache entry and is passed to the plugin
+func checkExecNames(sources []config.ExecSource) error {
+	seen := map[string]bool{}
+	for i, source := range sources {
+		if source.Name == "" {
+			return fmt.Errorf("exec source %d: Name is required", i+1)
+		}
+		if seen[source.Name] {
+			return fmt.Errorf("exec source %q: Name is used more than once", source.Name)
+		}
+		seen[source.Name] = true
+	}
+	return nil
+}
+
+func parseExecResponse(name string, output []byte, enableIpv6 bool) ([]Route, error) {
+	var response ExecResponse
+
+	decoder := json.NewDecoder(bytes.NewReader(output))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&response); err != nil {
+		return nil, fmt.Errorf("invalid plugin response: %v", err)
+	}
+
+	if response.Version != ProtocolVersion {
+		return nil, fmt.Errorf("unsupported plugin protocol version %q, expected %q", response.Version, ProtocolVersion)
+	}
+
+	var routes []Route
+	for i, item := range response.Prefixes {
+		prefix, isIpv6, err := NormalizePrefix(item.Prefix)
+		if err != nil {
+			return nil, fmt.Errorf("prefixes[%d]: %v", i, err)
+		}
+		if item.TTL < 0 {
+			return nil, fmt.Errorf("prefixes[%d]: ttl must not be negative", i)
+		}
+		for key := range item.Labels {
+			if key == "" {
+				return nil, fmt.Errorf("prefixes[%d]: label keys must not be empty", i)
+			}
+		}
+		if isIpv6 && !enableIpv6 {
+			logSkipped(name, prefix)
+			continue
+		}
+
+		routes = append(routes, Route{
+			Prefix: prefix,
+			TTL:    item.TTL,
+			Labels: item.Labels,
+			Source: "exec:" + name,
+		})
+	}
+
+	return routes, nil
+}
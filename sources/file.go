@@ -0,0 +1,79 @@
+package sources
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"tailscale-route-tiller/config"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func readFileSource(source config.FileSource, enableIpv6 bool) ([]Route, error) {
+	data, err := os.ReadFile(source.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := parseList(data, source.Format)
+	if err != nil {
+		return nil, err
+	}
+
+	return listRoutes(entries, "file:"+source.Path, enableIpv6)
+}
+
+// watchFiles reports changes to the file sources through inotify. The parent
+// directories are watched so editors that replace the file are noticed too.
+func watchFiles(ctx context.Context, files []config.FileSource, changes chan<- string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	watched := map[string]bool{}
+	for _, source := range files {
+		path, err := filepath.Abs(source.Path)
+		if err != nil {
+			watcher.Close()
+			return err
+		}
+		watched[path] = true
+		if err := watcher.Add(filepath.Dir(path)); err != nil {
+			watcher.Close()
+			return err
+		}
+	}
+
+	go func() {
+		defer watcher.Close()
+
+		// editors usually produce several events per save, so wait for them to settle
+		var pending string
+		settle := time.NewTimer(time.Hour)
+		settle.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event := <-watcher.Events:
+				if watched[filepath.Clean(event.Name)] {
+					pending = event.Name
+					settle.Reset(time.Second)
+				}
+			case err := <-watcher.Errors:
+				log.Println("Error watching route files: ", err)
+			case <-settle.C:
+				log.Println("Route file changed: ", pending)
+				if !notify(ctx, changes, "file:"+pending) {
+					return
+				}
+			}
+		}
+	}()
+
+	return nil
+}
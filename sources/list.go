@@ -0,0 +1,83 @@
+package sources
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"tailscale-route-tiller/utils"
+)
+
+// parseList reads a newline or JSON formatted list of CIDRs, IPs and hostnames
+func parseList(data []byte, format string) ([]string, error) {
+	if format == "" || format == "auto" {
+		format = "lines"
+		trimmed := bytes.TrimSpace(data)
+		if len(trimmed) > 0 && trimmed[0] == '[' {
+			format = "json"
+		}
+	}
+
+	var entries []string
+
+	switch format {
+	case "json":
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return nil, fmt.Errorf("invalid JSON list: %v", err)
+		}
+	case "lines":
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			line := scanner.Text()
+			if i := strings.Index(line, "#"); i >= 0 {
+				line = line[:i]
+			}
+			line = strings.TrimSpace(line)
+			if line != "" {
+				entries = append(entries, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown list format %q", format)
+	}
+
+	return entries, nil
+}
+
+// listRoutes turns list entries into routes, resolving hostnames like sites
+func listRoutes(entries []string, source string, enableIpv6 bool) ([]Route, error) {
+	var routes []Route
+	var hosts []string
+
+	for _, entry := range entries {
+		prefix, isIpv6, err := NormalizePrefix(entry)
+		if err != nil {
+			if strings.Contains(entry, "/") {
+				return nil, err
+			}
+			hosts = append(hosts, entry)
+			continue
+		}
+		if isIpv6 && !enableIpv6 {
+			logSkipped(source, prefix)
+			continue
+		}
+		routes = append(routes, Route{Prefix: prefix, Source: source})
+	}
+
+	if len(hosts) > 0 {
+		resolved, ttl, err := utils.PerformDNSLookupsWithTTL(hosts, enableIpv6)
+		if err != nil {
+			return nil, err
+		}
+		for _, prefix := range resolved {
+			routes = append(routes, Route{Prefix: prefix, TTL: ttl, Source: source})
+		}
+	}
+
+	return routes, nil
+}
@@ -0,0 +1,88 @@
+package sources
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"tailscale-route-tiller/utils"
+	"testing"
+)
+
+func TestParseList(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   string
+		format string
+		want   []string
+		ok     bool
+	}{
+		{"lines", "10.0.0.0/24\n10.0.1.1\napp.example.com\n", "lines", []string{"10.0.0.0/24", "10.0.1.1", "app.example.com"}, true},
+		{"comments and blank lines", "# office\n10.0.0.0/24  # main\n\n   \n  10.0.1.0/24\n#10.0.2.0/24\n", "lines", []string{"10.0.0.0/24", "10.0.1.0/24"}, true},
+		{"windows line endings", "10.0.0.0/24\r\n10.0.1.0/24\r\n", "lines", []string{"10.0.0.0/24", "10.0.1.0/24"}, true},
+		{"json", `["10.0.0.0/24", "app.example.com"]`, "json", []string{"10.0.0.0/24", "app.example.com"}, true},
+		{"invalid json", `["10.0.0.0/24"`, "json", nil, false},
+		{"json of the wrong type", `{"routes": []}`, "json", nil, false},
+		{"auto detects json", "  \n [\"10.0.0.0/24\"]", "auto", []string{"10.0.0.0/24"}, true},
+		{"auto detects lines", "10.0.0.0/24\n", "auto", []string{"10.0.0.0/24"}, true},
+		{"empty format is auto", `["10.0.0.0/24"]`, "", []string{"10.0.0.0/24"}, true},
+		{"empty", "", "auto", nil, true},
+		{"unknown format", "10.0.0.0/24", "csv", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseList([]byte(tt.data), tt.format)
+			if (err == nil) != tt.ok {
+				t.Fatalf("parseList() = %v, want ok %v", err, tt.ok)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseList() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListRoutes(t *testing.T) {
+	fixture := filepath.Join(t.TempDir(), "dns.yaml")
+	hosts := "app.example.com: [192.0.2.10, 192.0.2.11, \"2001:db8::10\"]\n"
+	if err := os.WriteFile(fixture, []byte(hosts), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := utils.LoadDNSFixture(fixture); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		entries    []string
+		enableIpv6 bool
+		want       []string
+		ok         bool
+	}{
+		{"cidrs and addresses", []string{"10.0.0.0/24", "10.0.1.1", "10.0.2.1/24"}, false, []string{"10.0.0.0/24", "10.0.1.1/32", "10.0.2.0/24"}, true},
+		{"ipv6 skipped", []string{"10.0.0.0/24", "2001:db8::/64"}, false, []string{"10.0.0.0/24"}, true},
+		{"ipv6 kept", []string{"2001:db8::1"}, true, []string{"2001:db8::1/128"}, true},
+		{"hostnames", []string{"10.0.0.0/24", "app.example.com"}, false, []string{"10.0.0.0/24", "192.0.2.10/32", "192.0.2.11/32"}, true},
+		{"hostnames with ipv6", []string{"app.example.com"}, true, []string{"192.0.2.10/32", "192.0.2.11/32", "2001:db8::10/128"}, true},
+		{"unknown hostname", []string{"missing.example.com"}, false, nil, true},
+		{"invalid cidr", []string{"10.0.0.0/33"}, false, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			routes, err := listRoutes(tt.entries, "file:test", tt.enableIpv6)
+			if (err == nil) != tt.ok {
+				t.Fatalf("listRoutes() = %v, want ok %v", err, tt.ok)
+			}
+			got := Prefixes(routes)
+			if len(got) != len(tt.want) || len(got) > 0 && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("listRoutes() = %q, want %q", got, tt.want)
+			}
+			for _, route := range routes {
+				if route.Source != "file:test" {
+					t.Errorf("route %s has source %q", route.Prefix, route.Source)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package sources
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"tailscale-route-tiller/awsutil"
+	"tailscale-route-tiller/config"
+	"tailscale-route-tiller/utils"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/route53"
+)
+
+func readRoute53Source(source config.Route53Source, enableIpv6 bool) ([]Route, error) {
+	region := source.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	sess, err := awsutil.NewSession(awsutil.Options{
+		Region:   region,
+		Endpoint: source.Endpoint,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	filter, err := newNameFilter(source.Include, source.IncludeRegex)
+	if err != nil {
+		return nil, err
+	}
+
+	name := "route53:" + source.HostedZoneId
+
+	var routes []Route
+	var aliasTargets []string
+
+	svc := route53.New(sess)
+	err = svc.ListResourceRecordSetsPages(&route53.ListResourceRecordSetsInput{
+		HostedZoneId: aws.String(source.HostedZoneId),
+	}, func(page *route53.ListResourceRecordSetsOutput, lastPage bool) bool {
+		for _, record := range page.ResourceRecordSets {
+			recordType := aws.StringValue(record.Type)
+			if recordType != route53.RRTypeA && recordType != route53.RRTypeAaaa {
+				continue
+			}
+			if recordType == route53.RRTypeAaaa && !enableIpv6 {
+				continue
+			}
+			if !filter.match(recordName(aws.StringValue(record.Name))) {
+				continue
+			}
+
+			if record.AliasTarget != nil {
+				aliasTargets = append(aliasTargets, strings.TrimSuffix(aws.StringValue(record.AliasTarget.DNSName), "."))
+				continue
+			}
+
+			for _, value := range record.ResourceRecords {
+				prefix, _, err := NormalizePrefix(aws.StringValue(value.Value))
+				if err != nil {
+					continue
+				}
+				routes = append(routes, Route{Prefix: prefix, TTL: int(aws.Int64Value(record.TTL)), Source: name})
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(aliasTargets) > 0 {
+		resolved, ttl, err := utils.PerformDNSLookupsWithTTL(utils.Unique(aliasTargets), enableIpv6)
+		if err != nil {
+			return nil, fmt.Errorf("resolving alias targets: %v", err)
+		}
+		for _, prefix := range resolved {
+			routes = append(routes, Route{Prefix: prefix, TTL: ttl, Source: name})
+		}
+	}
+
+	return routes, nil
+}
+
+// route53CacheKey identifies what a source reads. Sources for the same zone
+// with different filters return different routes, so they are cached apart.
+func route53CacheKey(source config.Route53Source) string {
+	include := append([]string{}, source.Include...)
+	includeRegex := append([]string{}, source.IncludeRegex...)
+	sort.Strings(include)
+	sort.Strings(includeRegex)
+
+	return fmt.Sprintf("route53:%s@%s include=%q regex=%q", source.HostedZoneId, source.Endpoint, include, includeRegex)
+}
+
+// recordName turns a Route53 record name into a plain lower case hostname
+func recordName(name string) string {
+	name = strings.TrimSuffix(name, ".")
+	name = strings.ReplaceAll(name, `\052`, "*")
+	return strings.ToLower(name)
+}
+
+type nameFilter struct {
+	globs   []string
+	regexes []*regexp.Regexp
+}
+
+func newNameFilter(globs []string, regexes []string) (*nameFilter, error) {
+	filter := &nameFilter{globs: globs}
+
+	for _, glob := range globs {
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("invalid glob %q: %v", glob, err)
+		}
+	}
+
+	for _, expr := range regexes {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex %q: %v", expr, err)
+		}
+		filter.regexes = append(filter.regexes, re)
+	}
+
+	return filter, nil
+}
+
+// match reports whether a name is selected; an empty filter selects every name
+func (f *nameFilter) match(name string) bool {
+	if len(f.globs) == 0 && len(f.regexes) == 0 {
+		return true
+	}
+
+	for _, glob := range f.globs {
+		if ok, _ := path.Match(strings.ToLower(glob), name); ok {
+			return true
+		}
+	}
+
+	for _, re := range f.regexes {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,198 @@
+package sources
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"tailscale-route-tiller/config"
+	"tailscale-route-tiller/enistore"
+	"time"
+)
+
+// Route is a single prefix returned by a route source
+type Route struct {
+	Prefix string
+	TTL    int
+	Labels map[string]string
+	Source string
+}
+
+type cacheEntry struct {
+	routes  []Route
+	expires time.Time
+}
+
+var cache = map[string]cacheEntry{}
+var cacheLock sync.Mutex
+
+// Collect gathers the routes from every configured source
+func Collect(cfg config.Config) ([]Route, error) {
+	var routes []Route
+
+	if err := checkExecNames(cfg.Sources.Exec); err != nil {
+		return nil, err
+	}
+	for _, source := range cfg.Sources.Exec {
+		results, err := cached("exec:"+source.Name, func() ([]Route, error) {
+			return runExecSource(source, cfg.EnableIpv6)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("exec source %q: %v", source.Name, err)
+		}
+		routes = append(routes, results...)
+	}
+
+	for _, source := range cfg.Sources.Files {
+		results, err := readFileSource(source, cfg.EnableIpv6)
+		if err != nil {
+			return nil, fmt.Errorf("file source %q: %v", source.Path, err)
+		}
+		routes = append(routes, results...)
+	}
+
+	for _, source := range cfg.Sources.URLs {
+		results, err := readURLSource(source, cfg.EnableIpv6)
+		if err != nil {
+			return nil, fmt.Errorf("url source %q: %v", source.URL, err)
+		}
+		routes = append(routes, results...)
+	}
+
+	for _, source := range cfg.Sources.Route53 {
+		results, err := cached(route53CacheKey(source), func() ([]Route, error) {
+			return readRoute53Source(source, cfg.EnableIpv6)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("route53 source %q: %v", source.HostedZoneId, err)
+		}
+		routes = append(routes, results...)
+	}
+
+	for _, source := range cfg.Sources.Consul {
+		results, err := readConsulSource(source, cfg.EnableIpv6)
+		if err != nil {
+			return nil, fmt.Errorf("consul source %q: %v", source.Address, err)
+		}
+		routes = append(routes, results...)
+	}
+
+	// routes learned from network interface events in worker mode
+	if cfg.EventRoutes.Enabled {
+		store, err := enistore.Open(cfg.EventRoutes.StateFile)
+		if err != nil {
+			return nil, fmt.Errorf("event routes: %v", err)
+		}
+		for _, prefix := range store.Prefixes() {
+			routes = append(routes, Route{Prefix: prefix, Source: "eni"})
+		}
+	}
+
+	return routes, nil
+}
+
+// Watch starts watching the sources that support change detection and
+// returns a channel that receives the name of each source that changed.
+// It returns nil when no configured source can be watched.
+func Watch(ctx context.Context, cfg config.Config) (<-chan string, error) {
+	if len(cfg.Sources.Files) == 0 && len(cfg.Sources.URLs) == 0 && len(cfg.Sources.Consul) == 0 {
+		return nil, nil
+	}
+
+	changes := make(chan string)
+
+	if len(cfg.Sources.Files) > 0 {
+		if err := watchFiles(ctx, cfg.Sources.Files, changes); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, source := range cfg.Sources.URLs {
+		go pollURL(ctx, source, changes)
+	}
+
+	for _, source := range cfg.Sources.Consul {
+		for _, service := range source.Services {
+			go watchConsul(ctx, source, service, changes)
+		}
+	}
+
+	return changes, nil
+}
+
+// notify reports a changed source, unless the context is cancelled first
+// because nobody is reading the changes anymore
+func notify(ctx context.Context, changes chan<- string, key string) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case changes <- key:
+		return true
+	}
+}
+
+// Prefixes returns just the prefixes of a list of routes
+func Prefixes(routes []Route) []string {
+	var prefixes []string
+	for _, route := range routes {
+		prefixes = append(prefixes, route.Prefix)
+	}
+	return prefixes
+}
+
+// cached returns the routes for key until the lowest TTL among them expires
+func cached(key string, fetch func() ([]Route, error)) ([]Route, error) {
+	cacheLock.Lock()
+	entry, ok := cache[key]
+	cacheLock.Unlock()
+
+	if ok && time.Now().Before(entry.expires) {
+		return entry.routes, nil
+	}
+
+	routes, err := fetch()
+	if err != nil {
+		return nil, err
+	}
+
+	lowestTTL := 0
+	for i, route := range routes {
+		if i == 0 || route.TTL < lowestTTL {
+			lowestTTL = route.TTL
+		}
+	}
+
+	cacheLock.Lock()
+	cache[key] = cacheEntry{routes: routes, expires: time.Now().Add(time.Duration(lowestTTL) * time.Second)}
+	cacheLock.Unlock()
+
+	return routes, nil
+}
+
+// NormalizePrefix turns a bare IP or CIDR into a CIDR string
+func NormalizePrefix(value string) (string, bool, error) {
+	value = strings.TrimSpace(value)
+
+	if strings.Contains(value, "/") {
+		ip, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return "", false, err
+		}
+		return network.String(), ip.To4() == nil, nil
+	}
+
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return "", false, fmt.Errorf("invalid IP address %q", value)
+	}
+	if ip.To4() != nil {
+		return ip.String() + "/32", false, nil
+	}
+	return ip.String() + "/128", true, nil
+}
+
+func logSkipped(source string, prefix string) {
+	log.Println("Skipping IPv6 prefix from", source, prefix, "(EnableIpv6 is false)")
+}
@@ -0,0 +1,120 @@
+package sources
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"tailscale-route-tiller/config"
+	"time"
+)
+
+const defaultPollInterval = 60
+
+type urlState struct {
+	etag         string
+	lastModified string
+	body         []byte
+}
+
+var urlStates = map[string]*urlState{}
+var urlLock sync.Mutex
+
+// fetchURL fetches a list with ETag/If-Modified-Since and reports whether it changed
+func fetchURL(source config.URLSource) ([]byte, bool, error) {
+	urlLock.Lock()
+	defer urlLock.Unlock()
+
+	state, ok := urlStates[source.URL]
+	if !ok {
+		state = &urlState{}
+		urlStates[source.URL] = state
+	}
+
+	req, err := http.NewRequest("GET", source.URL, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	for key, value := range source.Headers {
+		req.Header.Set(key, value)
+	}
+	if state.etag != "" {
+		req.Header.Set("If-None-Match", state.etag)
+	}
+	if state.lastModified != "" {
+		req.Header.Set("If-Modified-Since", state.lastModified)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && state.body != nil {
+		return state.body, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, false, err
+	}
+
+	changed := state.body != nil && !bytes.Equal(state.body, body)
+	state.body = body
+	state.etag = resp.Header.Get("ETag")
+	state.lastModified = resp.Header.Get("Last-Modified")
+
+	return body, changed, nil
+}
+
+func readURLSource(source config.URLSource, enableIpv6 bool) ([]Route, error) {
+	body, _, err := fetchURL(source)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := parseList(body, source.Format)
+	if err != nil {
+		return nil, err
+	}
+
+	return listRoutes(entries, "url:"+source.URL, enableIpv6)
+}
+
+// pollURL reports changes to a URL source until the context is cancelled
+func pollURL(ctx context.Context, source config.URLSource, changes chan<- string) {
+	interval := source.PollInterval
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_, changed, err := fetchURL(source)
+			if err != nil {
+				log.Println("Error polling route URL: ", source.URL, err)
+				continue
+			}
+			if changed {
+				log.Println("Route URL changed: ", source.URL)
+				if !notify(ctx, changes, "url:"+source.URL) {
+					return
+				}
+			}
+		}
+	}
+}
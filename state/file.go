@@ -0,0 +1,113 @@
+package state
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// DefaultPath is used when no state file is configured
+const DefaultPath = "route-history.jsonl"
+
+// fileStore appends revisions to a JSON lines file
+type fileStore struct {
+	path string
+	lock sync.Mutex
+}
+
+func openFile(path string) *fileStore {
+	if path == "" {
+		path = DefaultPath
+	}
+	return &fileStore{path: path}
+}
+
+func (s *fileStore) Append(rev *Revision) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	revisions, err := s.read()
+	if err != nil {
+		return err
+	}
+	rev.Number = 1
+	if len(revisions) > 0 {
+		rev.Number = revisions[len(revisions)-1].Number + 1
+	}
+
+	line, err := json.Marshal(rev)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+func (s *fileStore) List(limit int) ([]Revision, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	revisions, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	if limit > 0 && len(revisions) > limit {
+		revisions = revisions[len(revisions)-limit:]
+	}
+	return revisions, nil
+}
+
+func (s *fileStore) Get(number int) (*Revision, error) {
+	revisions, err := s.List(0)
+	if err != nil {
+		return nil, err
+	}
+	for i := range revisions {
+		if revisions[i].Number == number {
+			return &revisions[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no revision %d", number)
+}
+
+func (s *fileStore) read() ([]Revision, error) {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var revisions []Revision
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var rev Revision
+		if err := json.Unmarshal(scanner.Bytes(), &rev); err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", s.path, line, err)
+		}
+		revisions = append(revisions, rev)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sortRevisions(revisions)
+	return revisions, nil
+}
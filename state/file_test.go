@@ -0,0 +1,100 @@
+package state
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"tailscale-route-tiller/config"
+	"testing"
+)
+
+func TestFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	store, err := Open(config.State{Backend: "file", Path: path}, "n1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if revisions, err := store.List(0); err != nil || len(revisions) != 0 {
+		t.Fatalf("List() on a missing file = %v, %v, want nothing", revisions, err)
+	}
+
+	for i, routes := range [][]string{{"10.0.0.0/24"}, {"10.0.1.0/24"}, {"10.0.2.0/24"}} {
+		rev := &Revision{Device: "n1", Routes: routes}
+		if err := store.Append(rev); err != nil {
+			t.Fatal(err)
+		}
+		if rev.Number != i+1 {
+			t.Errorf("Append() numbered revision %d, want %d", rev.Number, i+1)
+		}
+	}
+
+	revisions, err := store.List(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := numbersOf(revisions); !reflect.DeepEqual(got, []int{1, 2, 3}) {
+		t.Errorf("List(0) = %v, want 1, 2, 3", got)
+	}
+	revisions, _ = store.List(2)
+	if got := numbersOf(revisions); !reflect.DeepEqual(got, []int{2, 3}) {
+		t.Errorf("List(2) = %v, want 2, 3", got)
+	}
+	revisions, _ = store.List(10)
+	if got := numbersOf(revisions); !reflect.DeepEqual(got, []int{1, 2, 3}) {
+		t.Errorf("List(10) = %v, want 1, 2, 3", got)
+	}
+
+	rev, err := store.Get(2)
+	if err != nil || rev.Routes[0] != "10.0.1.0/24" {
+		t.Errorf("Get(2) = %+v, %v", rev, err)
+	}
+	if _, err := store.Get(4); err == nil {
+		t.Error("Get(4) found a revision that was never written")
+	}
+}
+
+func TestFileStoreOrder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	lines := `{"revision":3,"routes":["c"]}
+
+{"revision":1,"routes":["a"]}
+{"revision":2,"routes":["b"]}
+`
+	if err := os.WriteFile(path, []byte(lines), 0600); err != nil {
+		t.Fatal(err)
+	}
+	store := openFile(path)
+
+	revisions, err := store.List(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := numbersOf(revisions); !reflect.DeepEqual(got, []int{1, 2, 3}) {
+		t.Errorf("List() = %v, want oldest first", got)
+	}
+
+	// numbering continues after the highest revision, not the last line
+	rev := &Revision{}
+	if err := store.Append(rev); err != nil || rev.Number != 4 {
+		t.Errorf("Append() = %d, %v, want revision 4", rev.Number, err)
+	}
+}
+
+func TestFileStoreCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	if err := os.WriteFile(path, []byte("{\"revision\":1}\nnot json\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openFile(path).List(0); err == nil {
+		t.Error("List() read a corrupt file without an error")
+	}
+}
+
+func numbersOf(revisions []Revision) []int {
+	var numbers []int
+	for _, rev := range revisions {
+		numbers = append(numbers, rev.Number)
+	}
+	return numbers
+}
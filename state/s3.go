@@ -0,0 +1,170 @@
+package state
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"tailscale-route-tiller/awsutil"
+	"tailscale-route-tiller/config"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// appendAttempts bounds how often Append renumbers a revision that lost a race
+const appendAttempts = 5
+
+// s3Store keeps one object per revision, named after its zero padded number
+// so that listing returns them in order. Revisions are only ever created, an
+// existing object is never overwritten.
+type s3Store struct {
+	svc    *s3.S3
+	bucket string
+	prefix string
+}
+
+func openS3(cfg config.State, device string) (*s3Store, error) {
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("the s3 state backend needs a Bucket")
+	}
+
+	sess, err := awsutil.NewSession(awsutil.Options{
+		Region:   cfg.Region,
+		Endpoint: cfg.Endpoint,
+		Profile:  cfg.Profile,
+		RoleARN:  cfg.RoleARN,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// MinIO and LocalStack don't do virtual host style buckets
+	extra := &aws.Config{}
+	if cfg.Endpoint != "" {
+		extra.S3ForcePathStyle = aws.Bool(true)
+	}
+
+	prefix := cfg.Prefix
+	if prefix == "" {
+		prefix = "route-tiller"
+	}
+
+	return &s3Store{svc: s3.New(sess, extra), bucket: cfg.Bucket, prefix: path.Join(prefix, device)}, nil
+}
+
+func (s *s3Store) key(number int) string {
+	return path.Join(s.prefix, fmt.Sprintf("%010d.json", number))
+}
+
+// numbers lists the revision numbers in the bucket, in order
+func (s *s3Store) numbers() ([]int, error) {
+	var numbers []int
+	err := s.svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(s.prefix + "/"),
+	}, func(page *s3.ListObjectsV2Output, last bool) bool {
+		for _, object := range page.Contents {
+			name := strings.TrimSuffix(path.Base(aws.StringValue(object.Key)), ".json")
+			if number, err := strconv.Atoi(name); err == nil {
+				numbers = append(numbers, number)
+			}
+		}
+		return true
+	})
+	sort.Ints(numbers)
+	return numbers, err
+}
+
+// Append numbers the revision after the latest one and creates its object
+// only if it does not exist yet. When another apply took the number in the
+// meantime, it tries again with the next one.
+func (s *s3Store) Append(rev *Revision) error {
+	for attempt := 1; ; attempt++ {
+		numbers, err := s.numbers()
+		if err != nil {
+			return err
+		}
+		rev.Number = 1
+		if len(numbers) > 0 {
+			rev.Number = numbers[len(numbers)-1] + 1
+		}
+
+		body, err := json.MarshalIndent(rev, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		req, _ := s.svc.PutObjectRequest(&s3.PutObjectInput{
+			Bucket:      aws.String(s.bucket),
+			Key:         aws.String(s.key(rev.Number)),
+			Body:        bytes.NewReader(body),
+			ContentType: aws.String("application/json"),
+		})
+		// the SDK has no field for conditional writes yet
+		req.Handlers.Build.PushBack(func(r *request.Request) {
+			r.HTTPRequest.Header.Set("If-None-Match", "*")
+		})
+		err = req.Send()
+		if !taken(err) || attempt == appendAttempts {
+			return err
+		}
+	}
+}
+
+// taken reports whether a conditional write failed because the object exists
+func taken(err error) bool {
+	if aerr, ok := err.(awserr.RequestFailure); ok {
+		return aerr.StatusCode() == http.StatusPreconditionFailed || aerr.StatusCode() == http.StatusConflict
+	}
+	return false
+}
+
+func (s *s3Store) List(limit int) ([]Revision, error) {
+	numbers, err := s.numbers()
+	if err != nil {
+		return nil, err
+	}
+	// only fetch the revisions that are asked for
+	if limit > 0 && len(numbers) > limit {
+		numbers = numbers[len(numbers)-limit:]
+	}
+
+	var revisions []Revision
+	for _, number := range numbers {
+		rev, err := s.Get(number)
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, *rev)
+	}
+
+	sortRevisions(revisions)
+	return revisions, nil
+}
+
+func (s *s3Store) Get(number int) (*Revision, error) {
+	result, err := s.svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(number)),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+		return nil, fmt.Errorf("no revision %d", number)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer result.Body.Close()
+
+	rev := &Revision{}
+	if err := json.NewDecoder(result.Body).Decode(rev); err != nil {
+		return nil, fmt.Errorf("revision %d: %v", number, err)
+	}
+	return rev, nil
+}
@@ -0,0 +1,165 @@
+package state
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"tailscale-route-tiller/config"
+	"testing"
+)
+
+// fakeS3 is a path style bucket in memory that lists two keys per page
+type fakeS3 struct {
+	lock    sync.Mutex
+	objects map[string][]byte
+	gets    int
+	// beforePut runs before a write is stored, to simulate a concurrent apply
+	beforePut func()
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+	switch {
+	case r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2":
+		var keys []string
+		for name := range f.objects {
+			if strings.HasPrefix(name, r.URL.Query().Get("prefix")) {
+				keys = append(keys, name)
+			}
+		}
+		sort.Strings(keys)
+
+		start, _ := strconv.Atoi(r.URL.Query().Get("continuation-token"))
+		end := start + 2
+		result := struct {
+			XMLName               xml.Name `xml:"ListBucketResult"`
+			IsTruncated           bool
+			NextContinuationToken string `xml:",omitempty"`
+			Contents              []struct{ Key string }
+		}{}
+		if end < len(keys) {
+			result.IsTruncated = true
+			result.NextContinuationToken = strconv.Itoa(end)
+		} else {
+			end = len(keys)
+		}
+		for _, name := range keys[start:end] {
+			result.Contents = append(result.Contents, struct{ Key string }{name})
+		}
+		xml.NewEncoder(w).Encode(result)
+
+	case r.Method == http.MethodGet:
+		f.gets++
+		body, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, `<Error><Code>NoSuchKey</Code></Error>`)
+			return
+		}
+		w.Write(body)
+
+	case r.Method == http.MethodPut:
+		body, _ := io.ReadAll(r.Body)
+		if f.beforePut != nil {
+			f.beforePut()
+			f.beforePut = nil
+		}
+		if _, exists := f.objects[key]; exists && r.Header.Get("If-None-Match") == "*" {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			io.WriteString(w, `<Error><Code>PreconditionFailed</Code></Error>`)
+			return
+		}
+		f.objects[key] = body
+	}
+}
+
+func testS3Store(t *testing.T) (*s3Store, *fakeS3) {
+	t.Helper()
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	t.Setenv("AWS_CONFIG_FILE", "/dev/null")
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", "/dev/null")
+
+	fake := &fakeS3{objects: map[string][]byte{}}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	store, err := openS3(config.State{Bucket: "bucket", Region: "us-east-1", Endpoint: server.URL}, "n1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, fake
+}
+
+func TestS3Store(t *testing.T) {
+	store, fake := testS3Store(t)
+
+	for i := 1; i <= 5; i++ {
+		rev := &Revision{Device: "n1", Routes: []string{"10.0." + strconv.Itoa(i) + ".0/24"}}
+		if err := store.Append(rev); err != nil {
+			t.Fatal(err)
+		}
+		if rev.Number != i {
+			t.Errorf("Append() numbered revision %d, want %d", rev.Number, i)
+		}
+	}
+	if _, ok := fake.objects["route-tiller/n1/0000000005.json"]; !ok {
+		t.Errorf("revision 5 not stored under its padded number, have %v", fake.objects)
+	}
+
+	fake.gets = 0
+	revisions, err := store.List(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := numbersOf(revisions); !reflect.DeepEqual(got, []int{4, 5}) {
+		t.Errorf("List(2) = %v, want 4, 5", got)
+	}
+	if fake.gets != 2 {
+		t.Errorf("List(2) fetched %d revisions, want 2", fake.gets)
+	}
+
+	revisions, err = store.List(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := numbersOf(revisions); !reflect.DeepEqual(got, []int{1, 2, 3, 4, 5}) {
+		t.Errorf("List(0) across pages = %v, want 1 to 5", got)
+	}
+
+	if rev, err := store.Get(3); err != nil || rev.Routes[0] != "10.0.3.0/24" {
+		t.Errorf("Get(3) = %+v, %v", rev, err)
+	}
+	if _, err := store.Get(9); err == nil || !strings.Contains(err.Error(), "no revision 9") {
+		t.Errorf("Get(9) = %v, want no revision", err)
+	}
+}
+
+func TestS3StoreAppendRace(t *testing.T) {
+	store, fake := testS3Store(t)
+
+	// another apply writes revision 1 between listing and writing
+	fake.beforePut = func() {
+		fake.objects["route-tiller/n1/0000000001.json"] = []byte(`{"revision":1,"routes":["other"]}`)
+	}
+
+	rev := &Revision{Routes: []string{"ours"}}
+	if err := store.Append(rev); err != nil {
+		t.Fatal(err)
+	}
+	if rev.Number != 2 {
+		t.Errorf("Append() numbered revision %d, want 2 after losing the race", rev.Number)
+	}
+	if string(fake.objects["route-tiller/n1/0000000001.json"]) != `{"revision":1,"routes":["other"]}` {
+		t.Error("Append() overwrote the other apply's revision")
+	}
+}
@@ -0,0 +1,79 @@
+package state
+
+import (
+	"fmt"
+	"sort"
+	"tailscale-route-tiller/config"
+	"time"
+)
+
+// Kinds of trigger recorded with a revision
+const (
+	TriggerCLI      = "cli"
+	TriggerSQS      = "sqs"
+	TriggerHTTP     = "http"
+	TriggerTimer    = "timer"
+	TriggerSource   = "source"
+	TriggerRollback = "rollback"
+)
+
+// Trigger records what caused an apply
+type Trigger struct {
+	Kind   string   `json:"kind"`
+	Detail string   `json:"detail,omitempty"`
+	Events []string `json:"events,omitempty"` // IDs of the events that led to the apply
+}
+
+func (t Trigger) String() string {
+	s := t.Kind
+	if t.Detail != "" {
+		s += " " + t.Detail
+	}
+	if len(t.Events) == 1 {
+		s += " event " + t.Events[0]
+	} else if len(t.Events) > 1 {
+		s += fmt.Sprintf(" %d events", len(t.Events))
+	}
+	return s
+}
+
+// Revision is one applied route set
+type Revision struct {
+	Number  int       `json:"revision"`
+	Time    time.Time `json:"time"`
+	Device  string    `json:"device"`
+	Trigger Trigger   `json:"trigger"`
+	Routes  []string  `json:"routes"`
+	Added   []string  `json:"added"`
+	Removed []string  `json:"removed"`
+}
+
+// Store keeps the history of applied route sets
+type Store interface {
+	// Append records a revision, numbering it after the latest one
+	Append(rev *Revision) error
+	// List returns the latest limit revisions, oldest first, or all of them
+	// when limit is 0
+	List(limit int) ([]Revision, error)
+	// Get returns a single revision
+	Get(number int) (*Revision, error)
+}
+
+// Open returns the configured store, or nil when history is disabled
+func Open(cfg config.State, device string) (Store, error) {
+	switch cfg.Backend {
+	case "":
+		return nil, nil
+	case "file":
+		return openFile(cfg.Path), nil
+	case "s3":
+		return openS3(cfg, device)
+	}
+	return nil, fmt.Errorf("unknown state backend %q", cfg.Backend)
+}
+
+func sortRevisions(revisions []Revision) {
+	sort.Slice(revisions, func(i, j int) bool {
+		return revisions[i].Number < revisions[j].Number
+	})
+}
@@ -50,6 +50,46 @@ func GetTailsScaleClientRouteSettings() ([]byte, error) {
 	return prettyJSON, nil
 }
 
+// Routes are the advertised and approved (enabled) routes of a device
+type Routes struct {
+	AdvertisedRoutes []string `json:"advertisedRoutes"`
+	EnabledRoutes    []string `json:"enabledRoutes"`
+}
+
+func GetRoutes() (*Routes, error) {
+	urlTemplate := "https://api.tailscale.com/api/v2/device/%s/routes"
+	url := fmt.Sprintf(urlTemplate, TailScaleClientId)
+	client := &http.Client{}
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		fmt.Println("Error creating request:", err)
+		return nil, err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+TailscaleKey)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Println("Error sending request:", err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status getting routes: %s", resp.Status)
+	}
+
+	routes := &Routes{}
+	err = json.NewDecoder(resp.Body).Decode(routes)
+	if err != nil {
+		fmt.Println("Error decoding routes:", err)
+		return nil, err
+	}
+
+	return routes, nil
+}
+
 func SetTailscaleApprovedSubnets(subnets []string) error {
 	urlTemplate := "https://api.tailscale.com/api/v2/device/%s/routes"
 	url := fmt.Sprintf(urlTemplate, TailScaleClientId)
@@ -94,5 +134,9 @@ func SetTailscaleApprovedSubnets(subnets []string) error {
 		fmt.Println("Response:", string(body))
 		return err
 	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status setting approved routes: %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
 	return nil
 }
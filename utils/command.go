@@ -0,0 +1,117 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CommandError is returned when a command cannot start, times out or exits non-zero
+type CommandError struct {
+	Args     []string
+	ExitCode int // -1 when the command did not run to completion
+	TimedOut bool
+	Stdout   string
+	Stderr   string
+	Err      error
+}
+
+func (e *CommandError) Error() string {
+	var what string
+	switch {
+	case e.TimedOut:
+		what = "timed out"
+	case e.ExitCode >= 0:
+		what = fmt.Sprintf("exited with code %d", e.ExitCode)
+	default:
+		what = "failed: " + e.Err.Error()
+	}
+
+	message := fmt.Sprintf("command %s %s", e.Args[0], what)
+	if stderr := strings.TrimSpace(e.Stderr); stderr != "" {
+		message += ": " + stderr
+	}
+	return message
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// CommandOptions control the environment, input and time limit of RunCommand
+type CommandOptions struct {
+	Timeout  time.Duration     // no limit when zero
+	Env      map[string]string // set on top of the environment
+	CleanEnv bool              // start from an environment with only PATH
+	Stdin    []byte            // written to the command's stdin
+}
+
+// RunCommand runs args directly, without a shell, and returns what it wrote
+// to stdout and stderr. Failures are returned as a *CommandError.
+func RunCommand(ctx context.Context, args []string, opts CommandOptions) (string, string, error) {
+	if len(args) == 0 {
+		return "", "", errors.New("empty command")
+	}
+
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Env = commandEnv(opts)
+	// don't hang on children that keep the output pipes open
+	cmd.WaitDelay = 5 * time.Second
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if opts.Stdin != nil {
+		cmd.Stdin = bytes.NewReader(opts.Stdin)
+	}
+
+	err := cmd.Run()
+	if err == nil {
+		return stdout.String(), stderr.String(), nil
+	}
+
+	commandErr := &CommandError{
+		Args:     args,
+		ExitCode: -1,
+		Stdout:   stdout.String(),
+		Stderr:   stderr.String(),
+		Err:      err,
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		commandErr.TimedOut = true
+	} else if exitErr, ok := err.(*exec.ExitError); ok {
+		commandErr.ExitCode = exitErr.ExitCode()
+	}
+	return commandErr.Stdout, commandErr.Stderr, commandErr
+}
+
+func commandEnv(opts CommandOptions) []string {
+	var env []string
+	if opts.CleanEnv {
+		env = []string{"PATH=" + os.Getenv("PATH")}
+	} else {
+		env = os.Environ()
+	}
+
+	keys := make([]string, 0, len(opts.Env))
+	for key := range opts.Env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		env = append(env, key+"="+opts.Env[key])
+	}
+	return env
+}
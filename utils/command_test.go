@@ -0,0 +1,85 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunCommand(t *testing.T) {
+	stdout, stderr, err := RunCommand(context.Background(), []string{"sh", "-c", `echo "out $1"; echo err >&2`, "sh", "a b"}, CommandOptions{})
+	if err != nil || stdout != "out a b\n" || stderr != "err\n" {
+		t.Errorf("RunCommand() = %q, %q, %v", stdout, stderr, err)
+	}
+}
+
+func TestRunCommandExitCode(t *testing.T) {
+	_, _, err := RunCommand(context.Background(), []string{"sh", "-c", "echo broken >&2; exit 3"}, CommandOptions{})
+
+	var commandErr *CommandError
+	if !errors.As(err, &commandErr) {
+		t.Fatalf("RunCommand() = %v, want a CommandError", err)
+	}
+	if commandErr.ExitCode != 3 || commandErr.TimedOut || commandErr.Stderr != "broken\n" {
+		t.Errorf("RunCommand() = %+v, want exit code 3", commandErr)
+	}
+	if !strings.Contains(err.Error(), "exited with code 3: broken") {
+		t.Errorf("error message %q does not name the exit code and stderr", err)
+	}
+}
+
+func TestRunCommandNotFound(t *testing.T) {
+	_, _, err := RunCommand(context.Background(), []string{"route-tiller-no-such-command"}, CommandOptions{})
+
+	var commandErr *CommandError
+	if !errors.As(err, &commandErr) || commandErr.ExitCode != -1 || commandErr.TimedOut {
+		t.Errorf("RunCommand() = %v, want a CommandError without an exit code", err)
+	}
+	if _, _, err := RunCommand(context.Background(), nil, CommandOptions{}); err == nil {
+		t.Error("RunCommand() with no args succeeded")
+	}
+}
+
+func TestRunCommandTimeout(t *testing.T) {
+	started := time.Now()
+	_, _, err := RunCommand(context.Background(), []string{"sleep", "10"}, CommandOptions{Timeout: 100 * time.Millisecond})
+
+	var commandErr *CommandError
+	if !errors.As(err, &commandErr) || !commandErr.TimedOut {
+		t.Fatalf("RunCommand() = %v, want a timeout", err)
+	}
+	if took := time.Since(started); took > 5*time.Second {
+		t.Errorf("RunCommand() took %s to time out", took)
+	}
+	if !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("error message %q does not say it timed out", err)
+	}
+}
+
+func TestRunCommandEnv(t *testing.T) {
+	os.Setenv("ROUTE_TILLER_TEST_INHERITED", "yes")
+	defer os.Unsetenv("ROUTE_TILLER_TEST_INHERITED")
+
+	script := `echo "$ROUTE_TILLER_TEST_INHERITED,$ROUTE_TILLER_TEST_SET,${PATH:+path}"`
+	env := map[string]string{"ROUTE_TILLER_TEST_SET": "set"}
+
+	stdout, _, err := RunCommand(context.Background(), []string{"sh", "-c", script}, CommandOptions{Env: env})
+	if err != nil || stdout != "yes,set,path\n" {
+		t.Errorf("RunCommand() = %q, %v, want the inherited and set variables", stdout, err)
+	}
+
+	stdout, _, err = RunCommand(context.Background(), []string{"sh", "-c", script}, CommandOptions{Env: env, CleanEnv: true})
+	if err != nil || stdout != ",set,path\n" {
+		t.Errorf("RunCommand() with CleanEnv = %q, %v, want only PATH and the set variables", stdout, err)
+	}
+}
+
+func TestRunCommandStdin(t *testing.T) {
+	stdout, _, err := RunCommand(context.Background(), []string{"cat"}, CommandOptions{Stdin: []byte(`{"phase":"pre"}`)})
+	if err != nil || stdout != `{"phase":"pre"}` {
+		t.Errorf("RunCommand() = %q, %v, want stdin echoed", stdout, err)
+	}
+}
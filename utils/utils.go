@@ -3,8 +3,7 @@ package utils
 import (
 	"fmt"
 	"log"
-	"os"
-	"os/exec"
+	"net/netip"
 	"strings"
 
 	"github.com/miekg/dns"
@@ -27,6 +26,61 @@ func Unique(slice []string) []string {
 	return list
 }
 
+// CanonicalPrefix returns a prefix the way the Tailscale API reports it, with
+// the address masked and in its shortest form, e.g. "fd00::/64" for
+// "FD00:0:0:0::1/64". Bare addresses become /32 or /128 routes, anything
+// else is returned unchanged.
+func CanonicalPrefix(value string) string {
+	value = strings.TrimSpace(value)
+	if prefix, err := netip.ParsePrefix(value); err == nil {
+		return prefix.Masked().String()
+	}
+	if addr, err := netip.ParseAddr(value); err == nil {
+		return netip.PrefixFrom(addr, addr.BitLen()).String()
+	}
+	return value
+}
+
+// CanonicalPrefixes canonicalises every prefix and drops the duplicates
+func CanonicalPrefixes(prefixes []string) []string {
+	canonical := make([]string, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		canonical = append(canonical, CanonicalPrefix(prefix))
+	}
+	return Unique(canonical)
+}
+
+// Diff returns the routes of desired missing from current, and the routes of
+// current missing from desired. Prefixes are compared in canonical form, which
+// is also what is returned.
+func Diff(current []string, desired []string) ([]string, []string) {
+	current = CanonicalPrefixes(current)
+	desired = CanonicalPrefixes(desired)
+
+	inCurrent := make(map[string]bool)
+	for _, entry := range current {
+		inCurrent[entry] = true
+	}
+	inDesired := make(map[string]bool)
+	for _, entry := range desired {
+		inDesired[entry] = true
+	}
+
+	added := []string{}
+	for _, entry := range desired {
+		if !inCurrent[entry] {
+			added = append(added, entry)
+		}
+	}
+	removed := []string{}
+	for _, entry := range current {
+		if !inDesired[entry] {
+			removed = append(removed, entry)
+		}
+	}
+	return added, removed
+}
+
 func getSystemDNS() (string, error) {
 	config, err := dns.ClientConfigFromFile("/etc/resolv.conf")
 	if err != nil || len(config.Servers) == 0 {
@@ -39,6 +93,10 @@ func getSystemDNS() (string, error) {
 func lookupIPsWithTTL(host string, enableIpv6 bool) ([]IPWithTTL, error) {
 	var results []IPWithTTL
 
+	if dnsFixture != nil {
+		return lookupFixture(host, enableIpv6), nil
+	}
+
 	dnsServer, err := getSystemDNS()
 	if err != nil {
 		return nil, err
@@ -124,19 +182,3 @@ func PerformDNSLookupsWithTTL(sites []string, enableIPv6 bool) ([]string, int, e
 	return subnetsList, lowestTTL, nil
 
 }
-
-func RunShellCommand(command string, testMode bool) string {
-	log.Println("command: ", command)
-	if !testMode {
-		commandTokens := strings.Split(command, " ")
-		cmd := exec.Command(commandTokens[0], commandTokens[1:]...)
-		output, err := cmd.Output()
-
-		if err != nil {
-			log.Printf("Failed to run command: %v\n", err)
-			os.Exit(1)
-		}
-		return string(output)
-	}
-	return "No Output, Test Mode"
-}
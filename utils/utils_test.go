@@ -0,0 +1,41 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCanonicalPrefix(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"10.0.0.0/24", "10.0.0.0/24"},
+		{"10.0.0.1/24", "10.0.0.0/24"},
+		{" 10.0.0.0/24 ", "10.0.0.0/24"},
+		{"10.1.2.3", "10.1.2.3/32"},
+		{"FD00::/64", "fd00::/64"},
+		{"fd00:0:0:0:0:0:0:0/64", "fd00::/64"},
+		{"fd00::1", "fd00::1/128"},
+		{"not-a-prefix", "not-a-prefix"},
+	}
+
+	for _, tt := range tests {
+		if got := CanonicalPrefix(tt.in); got != tt.want {
+			t.Errorf("CanonicalPrefix(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	added, removed := Diff(
+		[]string{"10.0.0.0/24", "fd00::/64", "10.9.0.0/16"},
+		[]string{"10.0.0.1/24", "FD00:0::/64", "10.5.0.0/16", "10.5.0.0/16"},
+	)
+	if !reflect.DeepEqual(added, []string{"10.5.0.0/16"}) {
+		t.Errorf("added = %v", added)
+	}
+	if !reflect.DeepEqual(removed, []string{"10.9.0.0/16"}) {
+		t.Errorf("removed = %v", removed)
+	}
+}
@@ -0,0 +1,106 @@
+package worker
+
+import (
+	"context"
+	"log"
+	"tailscale-route-tiller/config"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+)
+
+const defaultDebounce = 10
+const defaultMaxBatchAge = 60
+
+// receiveBatch long-polls for the first message and then keeps receiving until
+// no new message arrives within the debounce window or the batch gets too old.
+// Every received message is handed to the heartbeat straight away.
+func receiveBatch(ctx context.Context, svc sqsiface.SQSAPI, config config.Config, input *sqs.ReceiveMessageInput, hb *heartbeat) ([]*sqs.Message, error) {
+	result, err := svc.ReceiveMessageWithContext(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Messages) == 0 {
+		return nil, nil
+	}
+
+	batch := result.Messages
+	hb.track(result.Messages...)
+
+	debounce := config.Worker.Debounce
+	if debounce <= 0 {
+		debounce = defaultDebounce
+	}
+	maxBatchAge := config.Worker.MaxBatchAge
+	if maxBatchAge <= 0 {
+		maxBatchAge = defaultMaxBatchAge
+	}
+	deadline := time.Now().Add(time.Duration(maxBatchAge) * time.Second)
+
+	for {
+		wait := time.Duration(debounce) * time.Second
+		if remaining := time.Until(deadline); remaining < wait {
+			wait = remaining
+		}
+		if wait < time.Second {
+			break
+		}
+		// SQS caps long polling at 20 seconds
+		if wait > 20*time.Second {
+			wait = 20 * time.Second
+		}
+
+		debounceInput := *input
+		debounceInput.WaitTimeSeconds = aws.Int64(int64(wait / time.Second))
+
+		result, err := svc.ReceiveMessageWithContext(ctx, &debounceInput)
+		if err != nil {
+			return batch, err
+		}
+		if len(result.Messages) == 0 {
+			break
+		}
+		batch = append(batch, result.Messages...)
+		hb.track(result.Messages...)
+	}
+
+	log.Printf("Received a batch of %d messages", len(batch))
+	return batch, nil
+}
+
+// deleteMessages removes processed messages from the queue, ten at a time
+func deleteMessages(svc sqsiface.SQSAPI, config config.Config, messages []*sqs.Message) error {
+	for start := 0; start < len(messages); start += 10 {
+		end := start + 10
+		if end > len(messages) {
+			end = len(messages)
+		}
+
+		var entries []*sqs.DeleteMessageBatchRequestEntry
+		for _, message := range messages[start:end] {
+			entries = append(entries, &sqs.DeleteMessageBatchRequestEntry{
+				Id:            message.MessageId,
+				ReceiptHandle: message.ReceiptHandle,
+			})
+		}
+
+		var result *sqs.DeleteMessageBatchOutput
+		err := retry("delete messages", func() error {
+			var err error
+			result, err = svc.DeleteMessageBatch(&sqs.DeleteMessageBatchInput{
+				QueueUrl: &config.SQS.QueueURL,
+				Entries:  entries,
+			})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		for _, failed := range result.Failed {
+			log.Printf("Failed to delete message %s: %s", aws.StringValue(failed.Id), aws.StringValue(failed.Message))
+		}
+	}
+	return nil
+}
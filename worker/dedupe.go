@@ -0,0 +1,60 @@
+package worker
+
+import (
+	"log"
+	"tailscale-route-tiller/cloudwatchevent"
+)
+
+// eventID identifies an event across redeliveries. The CloudTrail event ID
+// stays the same when EventBridge delivers an event twice.
+func eventID(event *cloudwatchevent.CloudTrailEvent) string {
+	if event.Detail.EventID != "" {
+		return event.Detail.EventID
+	}
+	return event.ID
+}
+
+// EventIDs returns the IDs of the events, for reporting ones that were dropped
+func EventIDs(events []Event) []string {
+	var ids []string
+	for _, event := range events {
+		if id := eventID(event.CloudTrail); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// duplicate reports whether an event was already seen in this batch or processed before
+func (p *Pipeline) duplicate(id string, seen map[string]bool) bool {
+	if id == "" {
+		return false
+	}
+	if seen[id] {
+		return true
+	}
+	if p.dedupe == nil {
+		return false
+	}
+
+	processed, err := p.dedupe.Seen(id)
+	if err != nil {
+		// better to process an event twice than to drop it
+		log.Printf("Error checking dedupe store for %s: %v", id, err)
+		return false
+	}
+	return processed
+}
+
+// markProcessed records the events of a successful batch in the dedupe store
+func (p *Pipeline) markProcessed(ids []string) {
+	if p.dedupe == nil || p.testMode {
+		return
+	}
+
+	for _, id := range ids {
+		if err := p.dedupe.Mark(id); err != nil {
+			log.Printf("Error recording event %s in dedupe store: %v", id, err)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package worker
+
+import (
+	"log"
+	"tailscale-route-tiller/awsutil"
+	"tailscale-route-tiller/cloudwatchevent"
+	"tailscale-route-tiller/config"
+	"tailscale-route-tiller/enistore"
+	"tailscale-route-tiller/utils"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// describeBatchSize keeps each filter within the EC2 limit on filter values
+const describeBatchSize = 200
+
+// interfacePrefixes returns the private addresses of a created network interface as routes
+func interfacePrefixes(event *cloudwatchevent.CloudTrailEvent) []string {
+	networkInterface := event.Detail.ResponseElements.NetworkInterface
+
+	var prefixes []string
+	if prefix := prefixForIP(networkInterface.PrivateIpAddress); prefix != "" {
+		prefixes = append(prefixes, prefix)
+	}
+	for _, item := range networkInterface.PrivateIpAddressesSet.Item {
+		if prefix := prefixForIP(item.PrivateIpAddress); prefix != "" {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return utils.Unique(prefixes)
+}
+
+// applyEventRoutes records created interfaces in the store and withdraws deleted ones
+func applyEventRoutes(testMode bool, store *enistore.Store, events []*cloudwatchevent.CloudTrailEvent) {
+	for _, event := range events {
+		switch event.Detail.EventName {
+		case "CreateNetworkInterface":
+			eniID := event.Detail.ResponseElements.NetworkInterface.NetworkInterfaceId
+			prefixes := interfacePrefixes(event)
+			if eniID == "" || len(prefixes) == 0 {
+				continue
+			}
+
+			log.Println("Adding event routes for", eniID, prefixes)
+			if testMode {
+				continue
+			}
+			if err := store.Add(eniID, prefixes); err != nil {
+				log.Println("Error saving event routes: ", err.Error())
+			}
+
+		case "DeleteNetworkInterface":
+			eniID := event.Detail.RequestParameters.NetworkInterfaceId
+			if eniID == "" {
+				continue
+			}
+
+			log.Println("Withdrawing event routes for", eniID, store.Lookup(eniID))
+			if testMode {
+				continue
+			}
+			if _, err := store.Remove(eniID); err != nil {
+				log.Println("Error saving event routes: ", err.Error())
+			}
+		}
+	}
+}
+
+// pruneEventRoutes withdraws stored interfaces that no longer exist. A
+// DeleteNetworkInterface event that was lost or filtered out by the
+// EventBridge rule would otherwise keep their routes forever.
+func pruneEventRoutes(testMode bool, config config.Config, store *enistore.Store) {
+	if store == nil || !config.EventRoutes.Prune {
+		return
+	}
+
+	ids := store.IDs()
+	if len(ids) == 0 {
+		return
+	}
+
+	existing, err := existingInterfaces(config, ids)
+	if err != nil {
+		// without an answer nothing is known to be gone, so keep everything
+		log.Println("Error checking stored network interfaces: ", err.Error())
+		return
+	}
+
+	for _, eniID := range ids {
+		if existing[eniID] {
+			continue
+		}
+
+		log.Println("Withdrawing event routes for deleted", eniID, store.Lookup(eniID))
+		if testMode {
+			continue
+		}
+		if _, err := store.Remove(eniID); err != nil {
+			log.Println("Error saving event routes: ", err.Error())
+		}
+	}
+}
+
+// existingInterfaces returns which of the network interfaces still exist.
+// Filtering by ID, unlike asking for the IDs directly, doesn't fail the
+// whole call when one of them is gone.
+func existingInterfaces(config config.Config, ids []string) (map[string]bool, error) {
+	region := config.EventRoutes.Region
+	if region == "" {
+		region = config.SQS.Region
+	}
+	if region == "" {
+		region = "us-west-2"
+	}
+
+	sess, err := awsutil.NewSession(awsutil.Options{
+		Region:   region,
+		Endpoint: config.EventRoutes.Endpoint,
+		Profile:  config.EventRoutes.Profile,
+		RoleARN:  config.EventRoutes.RoleARN,
+	})
+	if err != nil {
+		return nil, err
+	}
+	svc := ec2.New(sess)
+
+	existing := map[string]bool{}
+	for start := 0; start < len(ids); start += describeBatchSize {
+		end := start + describeBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		input := &ec2.DescribeNetworkInterfacesInput{
+			Filters: []*ec2.Filter{{
+				Name:   aws.String("network-interface-id"),
+				Values: aws.StringSlice(ids[start:end]),
+			}},
+		}
+		err := svc.DescribeNetworkInterfacesPages(input, func(page *ec2.DescribeNetworkInterfacesOutput, lastPage bool) bool {
+			for _, networkInterface := range page.NetworkInterfaces {
+				existing[aws.StringValue(networkInterface.NetworkInterfaceId)] = true
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return existing, nil
+}
@@ -0,0 +1,82 @@
+package worker
+
+import (
+	"path/filepath"
+	"reflect"
+	"tailscale-route-tiller/cloudwatchevent"
+	"tailscale-route-tiller/enistore"
+	"testing"
+)
+
+const createWithSecondaries = `{"detail":{"eventName":"CreateNetworkInterface","responseElements":{"networkInterface":{
+	"networkInterfaceId":"eni-1","privateIpAddress":"10.0.0.5",
+	"privateIpAddressesSet":{"item":[
+		{"privateIpAddress":"10.0.0.5","primary":true},
+		{"privateIpAddress":"10.0.0.6","primary":false},
+		{"privateIpAddress":"10.0.0.7","primary":false}
+	]}}}}}`
+
+func TestInterfacePrefixes(t *testing.T) {
+	tests := []struct {
+		name  string
+		event string
+		want  []string
+	}{
+		{"primary and secondary addresses", createWithSecondaries, []string{"10.0.0.5/32", "10.0.0.6/32", "10.0.0.7/32"}},
+		{"primary only", `{"detail":{"responseElements":{"networkInterface":{"privateIpAddress":"10.0.0.5"}}}}`, []string{"10.0.0.5/32"}},
+		{"set only", `{"detail":{"responseElements":{"networkInterface":{"privateIpAddressesSet":{"item":[{"privateIpAddress":"10.0.0.8"}]}}}}}`, []string{"10.0.0.8/32"}},
+		{"ipv6", `{"detail":{"responseElements":{"networkInterface":{"privateIpAddress":"fd00::1"}}}}`, []string{"fd00::1/128"}},
+		{"invalid address", `{"detail":{"responseElements":{"networkInterface":{"privateIpAddress":"not-an-ip"}}}}`, nil},
+		{"no interface", `{"detail":{"eventName":"DeleteNetworkInterface"}}`, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := interfacePrefixes(parseEvent(t, tt.event))
+			if len(got) != len(tt.want) || len(got) > 0 && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("interfacePrefixes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyEventRoutes(t *testing.T) {
+	store, err := enistore.Open(filepath.Join(t.TempDir(), "eni.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Add("eni-old", []string{"10.0.9.9/32"}); err != nil {
+		t.Fatal(err)
+	}
+
+	events := func(raw ...string) []*cloudwatchevent.CloudTrailEvent {
+		var parsed []*cloudwatchevent.CloudTrailEvent
+		for _, event := range raw {
+			parsed = append(parsed, parseEvent(t, event))
+		}
+		return parsed
+	}
+	deleteOld := `{"detail":{"eventName":"DeleteNetworkInterface","requestParameters":{"networkInterfaceId":"eni-old"}}}`
+	createNoID := `{"detail":{"eventName":"CreateNetworkInterface","responseElements":{"networkInterface":{"privateIpAddress":"10.0.0.1"}}}}`
+	deleteNoID := `{"detail":{"eventName":"DeleteNetworkInterface"}}`
+
+	// test mode only logs
+	applyEventRoutes(true, store, events(createWithSecondaries, deleteOld))
+	if got := store.IDs(); !reflect.DeepEqual(got, []string{"eni-old"}) {
+		t.Fatalf("test mode changed the store to %v", got)
+	}
+
+	applyEventRoutes(false, store, events(createWithSecondaries, deleteOld, createNoID, deleteNoID))
+	if got := store.IDs(); !reflect.DeepEqual(got, []string{"eni-1"}) {
+		t.Errorf("IDs() = %v, want only the created interface", got)
+	}
+	if got := store.Lookup("eni-1"); !reflect.DeepEqual(got, []string{"10.0.0.5/32", "10.0.0.6/32", "10.0.0.7/32"}) {
+		t.Errorf("Lookup(eni-1) = %v, want the primary and secondary addresses", got)
+	}
+
+	// the delete of an interface that was never stored changes nothing
+	applyEventRoutes(false, store, events(deleteOld))
+	if got := store.IDs(); !reflect.DeepEqual(got, []string{"eni-1"}) {
+		t.Errorf("IDs() = %v after deleting an unknown interface", got)
+	}
+}
@@ -0,0 +1,149 @@
+package worker
+
+import (
+	"log"
+	"strconv"
+	"sync"
+	"tailscale-route-tiller/config"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+)
+
+const defaultVisibilityTimeout = 30
+
+// heartbeat keeps extending the visibility of in-flight messages so a long
+// settle wait or update does not hand them to another consumer
+type heartbeat struct {
+	svc        sqsiface.SQSAPI
+	config     config.Config
+	visibility int64
+	lock       sync.Mutex
+	messages   map[string]*sqs.Message
+	done       chan struct{}
+}
+
+// visibilityTimeout returns the configured visibility timeout, or the queue's own
+func visibilityTimeout(svc sqsiface.SQSAPI, config config.Config) int64 {
+	if config.SQS.VisibilityTimeout > 0 {
+		return config.SQS.VisibilityTimeout
+	}
+
+	result, err := svc.GetQueueAttributes(&sqs.GetQueueAttributesInput{
+		QueueUrl:       &config.SQS.QueueURL,
+		AttributeNames: []*string{aws.String(sqs.QueueAttributeNameVisibilityTimeout)},
+	})
+	if err != nil {
+		log.Printf("Could not read the queue visibility timeout, assuming %ds: %v", defaultVisibilityTimeout, err)
+		return defaultVisibilityTimeout
+	}
+
+	timeout, err := strconv.ParseInt(aws.StringValue(result.Attributes[sqs.QueueAttributeNameVisibilityTimeout]), 10, 64)
+	if err != nil || timeout <= 0 {
+		return defaultVisibilityTimeout
+	}
+	return timeout
+}
+
+func newHeartbeat(svc sqsiface.SQSAPI, config config.Config, visibility int64) *heartbeat {
+	h := &heartbeat{
+		svc:        svc,
+		config:     config,
+		visibility: visibility,
+		messages:   map[string]*sqs.Message{},
+		done:       make(chan struct{}),
+	}
+
+	// extend well before the current timeout runs out
+	interval := time.Duration(visibility) * time.Second / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-h.done:
+				return
+			case <-ticker.C:
+				h.extend(h.visibility)
+			}
+		}
+	}()
+
+	return h
+}
+
+// track adds messages to the set being kept invisible
+func (h *heartbeat) track(messages ...*sqs.Message) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for _, message := range messages {
+		h.messages[aws.StringValue(message.MessageId)] = message
+	}
+}
+
+// forget stops extending messages, usually because they were deleted
+func (h *heartbeat) forget(messages ...*sqs.Message) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for _, message := range messages {
+		delete(h.messages, aws.StringValue(message.MessageId))
+	}
+}
+
+// release makes the remaining messages visible again right away so another
+// consumer can pick them up, and stops the heartbeat
+func (h *heartbeat) release() {
+	h.stop()
+	h.extend(0)
+}
+
+func (h *heartbeat) stop() {
+	select {
+	case <-h.done:
+	default:
+		close(h.done)
+	}
+}
+
+func (h *heartbeat) extend(timeout int64) {
+	h.lock.Lock()
+	var messages []*sqs.Message
+	for _, message := range h.messages {
+		messages = append(messages, message)
+	}
+	h.lock.Unlock()
+
+	for start := 0; start < len(messages); start += 10 {
+		end := start + 10
+		if end > len(messages) {
+			end = len(messages)
+		}
+
+		var entries []*sqs.ChangeMessageVisibilityBatchRequestEntry
+		for _, message := range messages[start:end] {
+			entries = append(entries, &sqs.ChangeMessageVisibilityBatchRequestEntry{
+				Id:                message.MessageId,
+				ReceiptHandle:     message.ReceiptHandle,
+				VisibilityTimeout: aws.Int64(timeout),
+			})
+		}
+
+		result, err := h.svc.ChangeMessageVisibilityBatch(&sqs.ChangeMessageVisibilityBatchInput{
+			QueueUrl: &h.config.SQS.QueueURL,
+			Entries:  entries,
+		})
+		if err != nil {
+			log.Printf("Failed to change message visibility: %v", err)
+			continue
+		}
+		for _, failed := range result.Failed {
+			log.Printf("Failed to change visibility of message %s: %s", aws.StringValue(failed.Id), aws.StringValue(failed.Message))
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"tailscale-route-tiller/apply"
+	"tailscale-route-tiller/cloudwatchevent"
+	"tailscale-route-tiller/config"
+	"tailscale-route-tiller/dedupe"
+	"tailscale-route-tiller/enistore"
+	"tailscale-route-tiller/leader"
+	"tailscale-route-tiller/slack"
+	"tailscale-route-tiller/sources"
+	"tailscale-route-tiller/state"
+	"tailscale-route-tiller/utils"
+	"time"
+)
+
+// ErrAbandoned is returned by Handle when the context was cancelled before
+// the events were applied, so whoever delivered them can hand them out again
+var ErrAbandoned = errors.New("shutting down before the events were applied")
+
+// Event is a single event taken out of its envelope, with its raw JSON for rule matching
+type Event struct {
+	Raw        []byte
+	CloudTrail *cloudwatchevent.CloudTrailEvent
+}
+
+// ParseEvents unwraps a message body and parses the events inside it
+func ParseEvents(body []byte, verifier *cloudwatchevent.SNSVerifier) ([]Event, error) {
+	unwrapped, err := cloudwatchevent.Unwrap(body, verifier)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []Event
+	for _, inner := range unwrapped {
+		var event cloudwatchevent.CloudTrailEvent
+		err := json.Unmarshal(inner.Raw, &event)
+		if err != nil {
+			return nil, err
+		}
+		event.Envelope = inner.Envelope
+		events = append(events, Event{Raw: inner.Raw, CloudTrail: &event})
+	}
+	return events, nil
+}
+
+// Pipeline turns events into route updates, whether they come from the SQS
+// queue or the webhook server
+type Pipeline struct {
+	Verifier *cloudwatchevent.SNSVerifier
+	Source   string // trigger kind recorded with applies, such as sqs or http
+
+	testMode bool
+	config   config.Config
+	rules    []rule
+	eniStore *enistore.Store
+	dedupe   dedupe.Store
+	loops    sync.WaitGroup // background updates that Close waits for
+}
+
+// NewPipeline loads the rules and stores the pipeline needs
+func NewPipeline(testMode bool, config config.Config) (*Pipeline, error) {
+	p := &Pipeline{testMode: testMode, config: config}
+
+	var err error
+
+	// routes learned straight from network interface events
+	if config.EventRoutes.Enabled {
+		p.eniStore, err = enistore.Open(config.EventRoutes.StateFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open event route store, %v", err)
+		}
+	}
+
+	p.rules, err = compileRules(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load event rules, %v", err)
+	}
+
+	if config.SQS.SNSCertificateFile != "" {
+		p.Verifier, err = cloudwatchevent.NewSNSVerifier(config.SQS.SNSCertificateFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load SNS certificate, %v", err)
+		}
+	}
+
+	p.dedupe, err = dedupe.Open(config.Dedupe)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open dedupe store, %v", err)
+	}
+
+	return p, nil
+}
+
+// Start runs the background parts shared by every event source: leader
+// election, route source watching and the periodic reconcile
+func (p *Pipeline) Start(ctx context.Context) error {
+	config := p.config
+	testMode := p.testMode
+
+	// with several workers, only the lease holder applies changes
+	var err error
+	elector, err = leader.New(config.Leader, config.TailscaleclientId, func(leading bool) {
+		slack.PostLeadershipChange(elector.ID, leading, config.TailscaleclientId)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set up leader election, %v", err)
+	}
+	if elector != nil {
+		apply.Leading = elector.IsLeader
+		go elector.Run(ctx)
+	}
+
+	// react to route sources that report changes on their own
+	changes, err := sources.Watch(ctx, config)
+	if err != nil {
+		return fmt.Errorf("failed to watch route sources, %v", err)
+	}
+	if changes != nil {
+		p.loops.Add(1)
+		go func() {
+			defer p.loops.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case source := <-changes:
+					trigger := state.Trigger{Kind: state.TriggerSource, Detail: source}
+					if err := runUpdates(testMode, config, []string{"Route source changed: " + source}, "", []string{}, trigger); err != nil {
+						log.Println("Update after source change failed: ", err.Error())
+					}
+				}
+			}
+		}()
+	}
+
+	// catch drift from lost events or a misconfigured EventBridge rule
+	if config.Worker.ReconcileInterval > 0 {
+		p.loops.Add(1)
+		go func() {
+			defer p.loops.Done()
+			reconcileLoop(ctx, testMode, config, p.eniStore)
+		}()
+	}
+
+	return nil
+}
+
+// Close waits for the background updates to stop, then releases the leader
+// lease and the stores held by the pipeline. Call it once the event source
+// stopped, so no update is cut off halfway.
+func (p *Pipeline) Close() {
+	p.loops.Wait()
+	if elector != nil {
+		updateLock.Lock()
+		elector.Release()
+		updateLock.Unlock()
+	}
+	if p.dedupe != nil {
+		p.dedupe.Close()
+	}
+}
+
+// IsLeader reports whether this instance applies changes
+func (p *Pipeline) IsLeader() bool {
+	return elector == nil || elector.IsLeader()
+}
+
+// Reconcile re-resolves everything and applies the routes straight away
+func (p *Pipeline) Reconcile(reason string) error {
+	return runUpdates(p.testMode, p.config, []string{reason}, "", nil, state.Trigger{Kind: p.Source, Detail: reason})
+}
+
+// decision records what the rules made of one event
+type decision struct {
+	event     *cloudwatchevent.CloudTrailEvent
+	id        string
+	rule      string
+	action    string
+	duplicate bool
+	err       error
+}
+
+// batch is what a set of events asks for
+type batch struct {
+	decisions     []decision
+	events        []*cloudwatchevent.CloudTrailEvent // events that lead to an update
+	descriptions  []string
+	notifications []string
+	eventIDs      []string // marked as processed once the batch succeeds
+	reconcile     bool     // a full reconcile wins over re-resolving individual sites
+	refresh       []string
+}
+
+// classify skips duplicates and matches each event against the rules
+func (p *Pipeline) classify(items []Event) batch {
+	var b batch
+	seen := map[string]bool{}
+
+	for _, item := range items {
+		event := item.CloudTrail
+
+		id := eventID(event)
+		if p.duplicate(id, seen) {
+			log.Printf("Skipping duplicate event %s", id)
+			b.decisions = append(b.decisions, decision{event: event, id: id, duplicate: true})
+			continue
+		}
+		if id != "" {
+			seen[id] = true
+			b.eventIDs = append(b.eventIDs, id)
+		}
+
+		matched, err := matchRules(p.rules, item.Raw)
+		if err != nil {
+			log.Printf("Error matching event %s: %v", event.ID, err)
+			b.decisions = append(b.decisions, decision{event: event, id: id, err: err})
+			continue
+		}
+		log.Printf("Event %s (%s envelope) matched %q, action %s", event.ID, event.Envelope, matched.Name, matched.Action)
+		b.decisions = append(b.decisions, decision{event: event, id: id, rule: matched.Name, action: matched.Action})
+
+		switch matched.Action {
+		case ActionIgnore:
+		case ActionNotify:
+			b.notifications = append(b.notifications, event.Detail.RequestParameters.Description)
+		case ActionResolveSites:
+			b.refresh = append(b.refresh, matched.Sites...)
+			b.events = append(b.events, event)
+			b.descriptions = append(b.descriptions, event.Detail.RequestParameters.Description)
+		default:
+			// events for mapped load balancers only need their own sites
+			if sites := affectedSites(p.config, event); len(sites) > 0 {
+				b.refresh = append(b.refresh, sites...)
+			} else {
+				b.reconcile = true
+			}
+			b.events = append(b.events, event)
+			b.descriptions = append(b.descriptions, event.Detail.RequestParameters.Description)
+		}
+	}
+
+	if b.reconcile {
+		b.refresh = nil
+	} else {
+		b.refresh = utils.Unique(b.refresh)
+	}
+	return b
+}
+
+// sites returns the sites to poll while waiting for DNS
+func (b batch) sites(config config.Config) []string {
+	if b.reconcile {
+		return config.Sites
+	}
+	return b.refresh
+}
+
+// Handle matches a batch of events against the rules and runs one update for
+// all of them. It returns ErrAbandoned when the context is cancelled while
+// waiting for DNS, and the update error when the update fails.
+func (p *Pipeline) Handle(ctx context.Context, items []Event) error {
+	config := p.config
+	b := p.classify(items)
+
+	if len(b.notifications) > 0 {
+		slack.PostBatchSummary(b.notifications, "Notification only, routes were not changed", config.TailscaleclientId)
+	}
+
+	if len(b.events) > 0 {
+		// before running the update, wait until DNS reflects the events
+		log.Println("Waiting for DNS to settle...")
+		expectations := eventExpectations(b.events, p.eniStore)
+
+		took, ok := waitForDNS(ctx, config, b.sites(config), expectations)
+		if ctx.Err() != nil {
+			return ErrAbandoned
+		}
+
+		if p.eniStore != nil {
+			applyEventRoutes(p.testMode, p.eniStore, b.events)
+		}
+
+		var settleNote string
+		if ok {
+			settleNote = fmt.Sprintf("DNS settled after %s", took.Round(time.Second))
+		} else {
+			settleNote = fmt.Sprintf("DNS did not settle within %s, updating anyway", took.Round(time.Second))
+		}
+		log.Println(settleNote)
+
+		// one update covers every event in the batch, and is finished even when shutting down
+		trigger := state.Trigger{Kind: p.Source, Events: b.eventIDs}
+		err := runUpdates(p.testMode, config, b.descriptions, settleNote, b.refresh, trigger)
+		if err != nil {
+			return err
+		}
+	}
+
+	p.markProcessed(b.eventIDs)
+	return nil
+}
@@ -0,0 +1,104 @@
+package worker
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"tailscale-route-tiller/config"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+)
+
+const defaultMaxReceiveCount = 5
+
+// quarantinedMessage is what gets written to the quarantine directory
+type quarantinedMessage struct {
+	MessageID    string    `json:"messageId"`
+	ReceiveCount int       `json:"receiveCount"`
+	Reason       string    `json:"reason"`
+	Quarantined  time.Time `json:"quarantined"`
+	Body         string    `json:"body"`
+}
+
+func receiveCount(message *sqs.Message) int {
+	count, _ := strconv.Atoi(aws.StringValue(message.Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount]))
+	return count
+}
+
+// exhausted reports whether a message has been received too many times to try again
+func exhausted(config config.Config, message *sqs.Message) bool {
+	maxReceiveCount := config.SQS.MaxReceiveCount
+	if maxReceiveCount <= 0 {
+		maxReceiveCount = defaultMaxReceiveCount
+	}
+	return receiveCount(message) > maxReceiveCount
+}
+
+// deadLetter moves a message that cannot be processed out of the queue, to
+// the dead-letter queue or the quarantine directory when one is configured
+func deadLetter(svc sqsiface.SQSAPI, config config.Config, message *sqs.Message, reason string) error {
+	messageID := aws.StringValue(message.MessageId)
+	log.Printf("Dead-lettering message %s: %s", messageID, reason)
+
+	switch {
+	case config.SQS.DeadLetterQueueURL != "":
+		err := retry("send message to dead-letter queue", func() error {
+			_, err := svc.SendMessage(&sqs.SendMessageInput{
+				QueueUrl:    &config.SQS.DeadLetterQueueURL,
+				MessageBody: message.Body,
+				MessageAttributes: map[string]*sqs.MessageAttributeValue{
+					"FailureReason": {DataType: aws.String("String"), StringValue: aws.String(reason)},
+				},
+			})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+	case config.SQS.QuarantineDir != "":
+		buf, err := json.MarshalIndent(quarantinedMessage{
+			MessageID:    messageID,
+			ReceiveCount: receiveCount(message),
+			Reason:       reason,
+			Quarantined:  time.Now().UTC(),
+			Body:         aws.StringValue(message.Body),
+		}, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(config.SQS.QuarantineDir, 0o755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(config.SQS.QuarantineDir, messageID+".json"), buf, 0o644); err != nil {
+			return err
+		}
+
+	default:
+		log.Println("No dead-letter queue or quarantine directory configured, dropping message: ", aws.StringValue(message.Body))
+	}
+
+	return deleteMessages(svc, config, []*sqs.Message{message})
+}
+
+// retry runs an AWS call with exponential backoff until it succeeds or the attempts run out
+func retry(what string, call func() error) error {
+	backoff := time.Second
+	var err error
+
+	for attempt := 1; attempt <= 5; attempt++ {
+		err = call()
+		if err == nil {
+			return nil
+		}
+		log.Printf("Failed to %s (attempt %d), retrying in %s: %v", what, attempt, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	return err
+}
@@ -0,0 +1,84 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"log"
+	"tailscale-route-tiller/apply"
+	"tailscale-route-tiller/config"
+	"tailscale-route-tiller/enistore"
+	"tailscale-route-tiller/slack"
+	"tailscale-route-tiller/state"
+	"tailscale-route-tiller/tailscale"
+	"tailscale-route-tiller/utils"
+	"time"
+)
+
+// reconcileLoop runs a full reconcile on every tick until the context is cancelled
+func reconcileLoop(ctx context.Context, testMode bool, config config.Config, store *enistore.Store) {
+	ticker := time.NewTicker(time.Duration(config.Worker.ReconcileInterval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := reconcile(testMode, config, store); err != nil && !errors.Is(err, apply.ErrNotLeader) {
+				log.Println("Periodic reconcile failed: ", err.Error())
+			}
+		}
+	}
+}
+
+// reconcile re-resolves everything and compares it with what the device
+// advertises and has approved, applying the routes only when they drifted.
+// Stored event routes of deleted interfaces are dropped first. It shares
+// updateLock with event-triggered updates.
+func reconcile(testMode bool, config config.Config, store *enistore.Store) error {
+	updateLock.Lock()
+	defer updateLock.Unlock()
+
+	if elector != nil && !elector.IsLeader() {
+		return apply.ErrNotLeader
+	}
+
+	log.Println("Running periodic reconcile...")
+
+	pruneEventRoutes(testMode, config, store)
+
+	desired, err := desiredRoutes(config, nil)
+	if err != nil {
+		slack.PostError(err)
+		return err
+	}
+
+	current, err := tailscale.GetRoutes()
+	if err != nil {
+		return err
+	}
+
+	advertisedAdded, advertisedRemoved := utils.Diff(current.AdvertisedRoutes, desired)
+	approvedAdded, approvedRemoved := utils.Diff(current.EnabledRoutes, desired)
+
+	if len(advertisedAdded)+len(advertisedRemoved)+len(approvedAdded)+len(approvedRemoved) == 0 {
+		log.Println("Periodic reconcile found no drift")
+		return nil
+	}
+
+	added := utils.Unique(append(advertisedAdded, approvedAdded...))
+	removed := utils.Unique(append(advertisedRemoved, approvedRemoved...))
+	log.Println("Periodic reconcile found drift, added: ", added, " removed: ", removed)
+
+	if err := applyRoutes(testMode, config, desired, state.Trigger{Kind: state.TriggerTimer, Detail: "periodic reconcile"}); err != nil {
+		return err
+	}
+
+	if testMode {
+		return nil
+	}
+
+	log.Println("Periodic reconcile fixed the drift")
+	slack.PostDriftFixed(added, removed, config.TailscaleclientId)
+	return nil
+}
@@ -0,0 +1,261 @@
+package worker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"tailscale-route-tiller/config"
+	"tailscale-route-tiller/enistore"
+	"tailscale-route-tiller/tailscale"
+	"tailscale-route-tiller/utils"
+)
+
+// ReadMessages reads message bodies from files and directories of .json files,
+// or from stdin when no path or "-" is given. A file may hold several JSON
+// documents, and a top-level array is split into its elements.
+func ReadMessages(paths []string, stdin io.Reader) ([][]byte, error) {
+	if len(paths) == 0 {
+		paths = []string{"-"}
+	}
+
+	var bodies [][]byte
+	for _, path := range paths {
+		if path == "-" {
+			found, err := splitMessages(stdin)
+			if err != nil {
+				return nil, fmt.Errorf("stdin: %v", err)
+			}
+			bodies = append(bodies, found...)
+			continue
+		}
+
+		files := []string{path}
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if info.IsDir() {
+			files, err = filepath.Glob(filepath.Join(path, "*.json"))
+			if err != nil {
+				return nil, err
+			}
+			sort.Strings(files)
+		}
+
+		for _, file := range files {
+			f, err := os.Open(file)
+			if err != nil {
+				return nil, err
+			}
+			found, err := splitMessages(f)
+			f.Close()
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", file, err)
+			}
+			bodies = append(bodies, found...)
+		}
+	}
+	return bodies, nil
+}
+
+func splitMessages(r io.Reader) ([][]byte, error) {
+	var bodies [][]byte
+	decoder := json.NewDecoder(r)
+	for {
+		var raw json.RawMessage
+		err := decoder.Decode(&raw)
+		if err == io.EOF {
+			return bodies, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		trimmed := bytes.TrimSpace(raw)
+		if len(trimmed) > 0 && trimmed[0] == '[' {
+			var list []json.RawMessage
+			if err := json.Unmarshal(trimmed, &list); err != nil {
+				return nil, err
+			}
+			for _, item := range list {
+				bodies = append(bodies, item)
+			}
+			continue
+		}
+		bodies = append(bodies, trimmed)
+	}
+}
+
+// Replay runs message bodies through parsing, rule matching and planning as
+// one batch, and writes what would be resolved, changed and notified to out.
+// Nothing is sent to Tailscale or Slack, the dedupe store is not consulted
+// and event routes are applied to a scratch copy of the state file.
+func Replay(config config.Config, bodies [][]byte, out io.Writer) error {
+	config.Dedupe.Backend = ""
+
+	if config.EventRoutes.Enabled {
+		scratch, err := scratchStateFile(config.EventRoutes.StateFile)
+		if err != nil {
+			return fmt.Errorf("failed to copy event route store, %v", err)
+		}
+		defer os.RemoveAll(filepath.Dir(scratch))
+		config.EventRoutes.StateFile = scratch
+	}
+
+	p, err := NewPipeline(true, config)
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+
+	var items []Event
+	for i, body := range bodies {
+		events, err := ParseEvents(body, p.Verifier)
+		if err != nil {
+			fmt.Fprintf(out, "Message %d: unparseable, would be dead-lettered: %v\n", i+1, err)
+			continue
+		}
+		if len(events) == 0 {
+			fmt.Fprintf(out, "Message %d: no events\n", i+1)
+		}
+		items = append(items, events...)
+	}
+
+	b := p.classify(items)
+
+	fmt.Fprintf(out, "\nEvents (%d):\n", len(b.decisions))
+	for _, d := range b.decisions {
+		fmt.Fprintf(out, "  %s %s %q (%s envelope)\n", d.id, d.event.Detail.EventName, d.event.Detail.RequestParameters.Description, d.event.Envelope)
+		switch {
+		case d.duplicate:
+			fmt.Fprintln(out, "    duplicate, skipped")
+		case d.err != nil:
+			fmt.Fprintf(out, "    error matching rules: %v\n", d.err)
+		default:
+			fmt.Fprintf(out, "    rule %q, action %s\n", d.rule, d.action)
+		}
+	}
+
+	if len(b.notifications) > 0 {
+		fmt.Fprintf(out, "\nWould notify (%d):\n", len(b.notifications))
+		for _, description := range b.notifications {
+			fmt.Fprintf(out, "  %s\n", description)
+		}
+	}
+
+	if len(b.events) == 0 {
+		fmt.Fprintln(out, "\nNo update would run.")
+		return nil
+	}
+
+	sites := b.sites(config)
+	if b.reconcile {
+		fmt.Fprintf(out, "\nWould resolve all %d sites\n", len(sites))
+	} else {
+		fmt.Fprintf(out, "\nWould resolve %d of %d sites: %s\n", len(sites), len(config.Sites), strings.Join(sites, ", "))
+	}
+
+	// one poll of the settle wait, to show what the update would wait for
+	expectations := eventExpectations(b.events, p.eniStore)
+	if len(expectations) > 0 {
+		resolved, _, err := utils.PerformDNSLookupsWithTTL(sites, config.EnableIpv6)
+		if err != nil {
+			return err
+		}
+		baseline, _ := cachedSites(sites)
+		fmt.Fprintln(out, "\nDNS settle wait:")
+		for _, expected := range expectations {
+			if expected.changed && baseline == nil {
+				fmt.Fprintln(out, "  a delete with no known IP, would wait SettleMinWait")
+				continue
+			}
+			what := expected.prefix + " should appear"
+			if expected.changed {
+				what = "sites should change"
+			} else if !expected.present {
+				what = expected.prefix + " should disappear"
+			}
+			met := "met"
+			if !converged(resolved, baseline, []expectation{expected}) {
+				met = "not met yet"
+			}
+			fmt.Fprintf(out, "  %s, %s\n", what, met)
+		}
+		if converged(resolved, baseline, expectations) && (baseline != nil || !needsChange(expectations)) {
+			fmt.Fprintln(out, "  DNS has settled, the update would run straight away")
+		} else {
+			fmt.Fprintln(out, "  DNS has not settled, the update would wait up to SettleMaxWait")
+		}
+	}
+
+	if p.eniStore != nil {
+		applyEventRoutes(false, p.eniStore, b.events)
+	}
+
+	desired, err := desiredRoutes(config, b.refresh)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "\nDesired routes (%d):\n", len(desired))
+	for _, prefix := range desired {
+		fmt.Fprintf(out, "  %s\n", prefix)
+	}
+
+	if config.TailscaleKey == "" {
+		fmt.Fprintln(out, "\nNo TailscaleKey configured, not comparing with the current routes")
+		return nil
+	}
+
+	current, err := tailscale.GetRoutes()
+	if err != nil {
+		fmt.Fprintf(out, "\nCould not read the current routes, not comparing: %v\n", err)
+		return nil
+	}
+
+	added, removed := utils.Diff(current.AdvertisedRoutes, desired)
+	if len(added)+len(removed) == 0 {
+		fmt.Fprintln(out, "\nNo changes to the advertised routes")
+		return nil
+	}
+	fmt.Fprintln(out, "\nChanges to the advertised routes:")
+	for _, prefix := range added {
+		fmt.Fprintf(out, "  + %s\n", prefix)
+	}
+	for _, prefix := range removed {
+		fmt.Fprintf(out, "  - %s\n", prefix)
+	}
+	return nil
+}
+
+// scratchStateFile copies the event route store to a temporary directory
+func scratchStateFile(path string) (string, error) {
+	if path == "" {
+		path = enistore.DefaultPath
+	}
+
+	dir, err := os.MkdirTemp("", "route-tiller-replay")
+	if err != nil {
+		return "", err
+	}
+	scratch := filepath.Join(dir, filepath.Base(path))
+
+	buf, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return scratch, nil
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	if err := os.WriteFile(scratch, buf, 0600); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return scratch, nil
+}
@@ -0,0 +1,92 @@
+package worker
+
+import (
+	"fmt"
+	"os"
+	"tailscale-route-tiller/config"
+	"tailscale-route-tiller/eventpattern"
+)
+
+const (
+	ActionReconcile    = "reconcile"
+	ActionResolveSites = "resolve-sites"
+	ActionNotify       = "notify"
+	ActionIgnore       = "ignore"
+)
+
+type rule struct {
+	config.Rule
+	pattern *eventpattern.Pattern
+}
+
+// compileRules parses the patterns of the configured rules
+func compileRules(config config.Config) ([]rule, error) {
+	var rules []rule
+
+	sites := map[string]bool{}
+	for _, site := range config.Sites {
+		sites[site] = true
+	}
+
+	for i, configured := range config.Rules {
+		name := configured.Name
+		if name == "" {
+			name = fmt.Sprintf("rule %d", i+1)
+			configured.Name = name
+		}
+
+		data := []byte(configured.Pattern)
+		if configured.PatternFile != "" {
+			var err error
+			data, err = os.ReadFile(configured.PatternFile)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+		}
+
+		pattern, err := eventpattern.Parse(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+
+		switch configured.Action {
+		case ActionReconcile, ActionNotify, ActionIgnore:
+		case ActionResolveSites:
+			if len(configured.Sites) == 0 {
+				return nil, fmt.Errorf("%s: resolve-sites needs a list of sites", name)
+			}
+			// only sites that are configured ever become routes
+			for _, site := range configured.Sites {
+				if !sites[site] {
+					return nil, fmt.Errorf("%s: site %q is not listed in sites", name, site)
+				}
+			}
+		default:
+			return nil, fmt.Errorf("%s: unknown action %q", name, configured.Action)
+		}
+
+		rules = append(rules, rule{Rule: configured, pattern: pattern})
+	}
+
+	return rules, nil
+}
+
+// matchRules returns the first rule matching the raw event. Without any rules
+// every event triggers a full reconcile; with rules, unmatched events are ignored.
+func matchRules(rules []rule, event []byte) (rule, error) {
+	if len(rules) == 0 {
+		return rule{Rule: config.Rule{Name: "default", Action: ActionReconcile}}, nil
+	}
+
+	for _, candidate := range rules {
+		ok, err := candidate.pattern.Match(event)
+		if err != nil {
+			return rule{}, err
+		}
+		if ok {
+			return candidate, nil
+		}
+	}
+
+	return rule{Rule: config.Rule{Name: "no match", Action: ActionIgnore}}, nil
+}
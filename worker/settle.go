@@ -0,0 +1,169 @@
+package worker
+
+import (
+	"context"
+	"log"
+	"net"
+	"tailscale-route-tiller/cloudwatchevent"
+	"tailscale-route-tiller/config"
+	"tailscale-route-tiller/enistore"
+	"tailscale-route-tiller/utils"
+	"time"
+)
+
+const defaultSettleMaxWait = 300
+const defaultSettleInterval = 10
+const defaultSettleMinWait = 120
+
+// expectation is an address that should show up in, or vanish from, DNS. A
+// delete whose address is not known expects the sites to resolve to something
+// else than before instead.
+type expectation struct {
+	prefix  string
+	present bool
+	changed bool
+}
+
+func prefixForIP(address string) string {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return ""
+	}
+	if ip.To4() != nil {
+		return ip.String() + "/32"
+	}
+	return ip.String() + "/128"
+}
+
+// eventExpectations lists what DNS should look like once the events have
+// settled. Delete events carry no address, so when an ENI store is given the
+// address recorded for the interface is used instead. Without one, the sites
+// are expected to change.
+func eventExpectations(events []*cloudwatchevent.CloudTrailEvent, store *enistore.Store) []expectation {
+	var expectations []expectation
+
+	for _, event := range events {
+		prefix := prefixForIP(event.Detail.ResponseElements.NetworkInterface.PrivateIpAddress)
+
+		switch event.Detail.EventName {
+		case "CreateNetworkInterface":
+			if prefix != "" {
+				expectations = append(expectations, expectation{prefix: prefix, present: true})
+			}
+		case "DeleteNetworkInterface":
+			if prefix != "" {
+				expectations = append(expectations, expectation{prefix: prefix, present: false})
+				continue
+			}
+			var stored []string
+			if store != nil {
+				stored = store.Lookup(event.Detail.RequestParameters.NetworkInterfaceId)
+			}
+			for _, prefix := range stored {
+				expectations = append(expectations, expectation{prefix: prefix, present: false})
+			}
+			if len(stored) == 0 {
+				expectations = append(expectations, expectation{changed: true})
+			}
+		}
+	}
+
+	return expectations
+}
+
+// waitForDNS polls the given sites until every expectation is met or the maximum
+// wait runs out, and returns how long it took and whether DNS converged. It
+// gives up early when the context is cancelled. A delete without a known address
+// waits for the sites to differ from their cached results, or for SettleMinWait
+// when they have not been resolved before.
+func waitForDNS(ctx context.Context, config config.Config, sites []string, expectations []expectation) (time.Duration, bool) {
+	started := time.Now()
+
+	if len(expectations) == 0 {
+		return 0, true
+	}
+
+	maxWait := config.Worker.SettleMaxWait
+	if maxWait <= 0 {
+		maxWait = defaultSettleMaxWait
+	}
+	interval := config.Worker.SettleInterval
+	if interval <= 0 {
+		interval = defaultSettleInterval
+	}
+	deadline := started.Add(time.Duration(maxWait) * time.Second)
+
+	baseline, cached := cachedSites(sites)
+	var minWait time.Duration
+	if !cached && needsChange(expectations) {
+		minWait = time.Duration(config.Worker.SettleMinWait) * time.Second
+		if minWait <= 0 {
+			minWait = defaultSettleMinWait * time.Second
+		}
+	}
+
+	for {
+		resolved, _, err := utils.PerformDNSLookupsWithTTL(sites, config.EnableIpv6)
+		if err != nil {
+			log.Println("Error polling DNS: ", err.Error())
+		} else if converged(resolved, baseline, expectations) && time.Since(started) >= minWait {
+			return time.Since(started), true
+		}
+
+		if time.Now().Add(time.Duration(interval) * time.Second).After(deadline) {
+			return time.Since(started), false
+		}
+		if !sleep(ctx, time.Duration(interval)*time.Second) {
+			return time.Since(started), false
+		}
+	}
+}
+
+// sleep waits for the duration and reports false if the context was cancelled first
+func sleep(ctx context.Context, duration time.Duration) bool {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// converged reports whether the resolved prefixes meet every expectation. An
+// expected change is only checked against a baseline, without one the caller
+// has to wait instead.
+func converged(resolved []string, baseline []string, expectations []expectation) bool {
+	found := map[string]bool{}
+	for _, prefix := range resolved {
+		found[prefix] = true
+	}
+
+	for _, expected := range expectations {
+		if expected.changed {
+			if baseline == nil {
+				continue
+			}
+			added, removed := utils.Diff(baseline, resolved)
+			if len(added) == 0 && len(removed) == 0 {
+				return false
+			}
+			continue
+		}
+		if found[expected.prefix] != expected.present {
+			return false
+		}
+	}
+	return true
+}
+
+func needsChange(expectations []expectation) bool {
+	for _, expected := range expectations {
+		if expected.changed {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,98 @@
+package worker
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"tailscale-route-tiller/cloudwatchevent"
+	"tailscale-route-tiller/enistore"
+	"testing"
+)
+
+func parseEvent(t *testing.T, raw string) *cloudwatchevent.CloudTrailEvent {
+	t.Helper()
+	event := &cloudwatchevent.CloudTrailEvent{}
+	if err := json.Unmarshal([]byte(raw), event); err != nil {
+		t.Fatalf("parsing %s: %v", raw, err)
+	}
+	return event
+}
+
+func TestConverged(t *testing.T) {
+	appear := expectation{prefix: "10.0.0.5/32", present: true}
+	vanish := expectation{prefix: "10.0.0.6/32", present: false}
+	change := expectation{changed: true}
+
+	tests := []struct {
+		name         string
+		resolved     []string
+		baseline     []string
+		expectations []expectation
+		want         bool
+	}{
+		{"nothing expected", []string{"10.0.0.1/32"}, nil, nil, true},
+		{"address appeared", []string{"10.0.0.1/32", "10.0.0.5/32"}, nil, []expectation{appear}, true},
+		{"address not there yet", []string{"10.0.0.1/32"}, nil, []expectation{appear}, false},
+		{"address gone", []string{"10.0.0.1/32"}, nil, []expectation{vanish}, true},
+		{"address still there", []string{"10.0.0.6/32"}, nil, []expectation{vanish}, false},
+		{"every expectation must hold", []string{"10.0.0.5/32", "10.0.0.6/32"}, nil, []expectation{appear, vanish}, false},
+		{"sites changed", []string{"10.0.0.1/32"}, []string{"10.0.0.1/32", "10.0.0.9/32"}, []expectation{change}, true},
+		{"sites unchanged", []string{"10.0.0.9/32", "10.0.0.1/32"}, []string{"10.0.0.1/32", "10.0.0.9/32"}, []expectation{change}, false},
+		{"sites unchanged in another form", []string{"10.0.0.1"}, []string{"10.0.0.1/32"}, []expectation{change}, false},
+		{"change without a baseline", []string{"10.0.0.1/32"}, nil, []expectation{change}, true},
+		{"change and an address", []string{"10.0.0.1/32"}, []string{"10.0.0.2/32"}, []expectation{change, appear}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := converged(tt.resolved, tt.baseline, tt.expectations); got != tt.want {
+				t.Errorf("converged() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEventExpectations(t *testing.T) {
+	store, err := enistore.Open(filepath.Join(t.TempDir(), "eni.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Add("eni-known", []string{"10.0.0.7/32", "10.0.0.8/32"}); err != nil {
+		t.Fatal(err)
+	}
+
+	create := `{"detail":{"eventName":"CreateNetworkInterface","responseElements":{"networkInterface":{"networkInterfaceId":"eni-new","privateIpAddress":"10.0.0.5"}}}}`
+	createV6 := `{"detail":{"eventName":"CreateNetworkInterface","responseElements":{"networkInterface":{"privateIpAddress":"fd00::5"}}}}`
+	createNoIP := `{"detail":{"eventName":"CreateNetworkInterface"}}`
+	deleteKnown := `{"detail":{"eventName":"DeleteNetworkInterface","requestParameters":{"networkInterfaceId":"eni-known"}}}`
+	deleteUnknown := `{"detail":{"eventName":"DeleteNetworkInterface","requestParameters":{"networkInterfaceId":"eni-other"}}}`
+	other := `{"detail":{"eventName":"ModifyNetworkInterfaceAttribute"}}`
+
+	tests := []struct {
+		name   string
+		events []string
+		store  *enistore.Store
+		want   []expectation
+	}{
+		{"create", []string{create}, nil, []expectation{{prefix: "10.0.0.5/32", present: true}}},
+		{"create ipv6", []string{createV6}, nil, []expectation{{prefix: "fd00::5/128", present: true}}},
+		{"create without an address", []string{createNoIP}, nil, nil},
+		{"delete from the store", []string{deleteKnown}, store, []expectation{{prefix: "10.0.0.7/32"}, {prefix: "10.0.0.8/32"}}},
+		{"delete not in the store", []string{deleteUnknown}, store, []expectation{{changed: true}}},
+		{"delete without a store", []string{deleteKnown}, nil, []expectation{{changed: true}}},
+		{"other events", []string{other}, store, nil},
+		{"batch", []string{create, deleteKnown}, store, []expectation{{prefix: "10.0.0.5/32", present: true}, {prefix: "10.0.0.7/32"}, {prefix: "10.0.0.8/32"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var events []*cloudwatchevent.CloudTrailEvent
+			for _, raw := range tt.events {
+				events = append(events, parseEvent(t, raw))
+			}
+			if got := eventExpectations(events, tt.store); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("eventExpectations() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
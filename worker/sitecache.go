@@ -0,0 +1,64 @@
+package worker
+
+import (
+	"log"
+	"sync"
+	"tailscale-route-tiller/config"
+	"tailscale-route-tiller/utils"
+)
+
+// siteCache holds the last resolved prefixes of every site, so an event can
+// re-resolve just the sites it affects. It is updated under updateLock, and
+// siteCacheLock guards it for the settle wait, which runs outside of it.
+var siteCache = map[string][]string{}
+var siteCacheLock sync.Mutex
+
+// cachedSites returns the cached prefixes of the given sites, and false when
+// any of them has not been resolved yet
+func cachedSites(sites []string) ([]string, bool) {
+	siteCacheLock.Lock()
+	defer siteCacheLock.Unlock()
+
+	prefixes := []string{}
+	for _, site := range sites {
+		cached, ok := siteCache[site]
+		if !ok {
+			return nil, false
+		}
+		prefixes = append(prefixes, cached...)
+	}
+	return prefixes, true
+}
+
+// resolveSites re-resolves the given sites, or all of them when refresh is
+// nil, and combines the results with the cached prefixes of the other sites
+func resolveSites(config config.Config, refresh []string) ([]string, error) {
+	wanted := map[string]bool{}
+	for _, site := range refresh {
+		wanted[site] = true
+	}
+
+	var resolvedSubnets []string
+	resolved := 0
+	for _, site := range config.Sites {
+		siteCacheLock.Lock()
+		cached, ok := siteCache[site]
+		siteCacheLock.Unlock()
+		if refresh == nil || wanted[site] || !ok {
+			resolved++
+			results, _, err := utils.PerformDNSLookupsWithTTL([]string{site}, config.EnableIpv6)
+			if err != nil {
+				return nil, err
+			}
+			siteCacheLock.Lock()
+			siteCache[site] = results
+			siteCacheLock.Unlock()
+			cached = results
+		}
+		resolvedSubnets = append(resolvedSubnets, cached...)
+	}
+
+	log.Printf("Resolved %d of %d sites, reused cached results for the rest", resolved, len(config.Sites))
+
+	return resolvedSubnets, nil
+}
@@ -0,0 +1,43 @@
+package worker
+
+import (
+	"strings"
+	"tailscale-route-tiller/cloudwatchevent"
+	"tailscale-route-tiller/config"
+)
+
+// loadBalancerName extracts the name from an ENI description such as
+// "ELB app/my-alb/50dc6c495c0c9188", or "ELB my-elb" for a Classic ELB
+func loadBalancerName(description string) string {
+	if !strings.HasPrefix(description, "ELB ") {
+		return ""
+	}
+	parts := strings.Split(strings.TrimPrefix(description, "ELB "), "/")
+	switch len(parts) {
+	case 1:
+		return parts[0]
+	case 3:
+		return parts[1]
+	}
+	return ""
+}
+
+// affectedSites returns the sites mapped to the load balancer of an event, or
+// nil when the event is not covered by any mapping
+func affectedSites(config config.Config, event *cloudwatchevent.CloudTrailEvent) []string {
+	description := event.Detail.RequestParameters.Description
+	if description == "" {
+		description = event.Detail.ResponseElements.NetworkInterface.Description
+	}
+	name := loadBalancerName(description)
+
+	var sites []string
+	for _, mapping := range config.SiteMappings {
+		if mapping.DescriptionPrefix != "" && strings.HasPrefix(description, mapping.DescriptionPrefix) {
+			sites = append(sites, mapping.Sites...)
+		} else if mapping.LoadBalancer != "" && mapping.LoadBalancer == name {
+			sites = append(sites, mapping.Sites...)
+		}
+	}
+	return sites
+}
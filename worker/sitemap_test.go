@@ -0,0 +1,65 @@
+package worker
+
+import (
+	"reflect"
+	"tailscale-route-tiller/config"
+	"testing"
+)
+
+func TestLoadBalancerName(t *testing.T) {
+	tests := []struct {
+		description string
+		want        string
+	}{
+		{"ELB app/my-alb/50dc6c495c0c9188", "my-alb"},
+		{"ELB net/internal-nlb/1a2b3c4d5e6f7a8b", "internal-nlb"},
+		{"ELB my-classic-elb", "my-classic-elb"},
+		{"ELB app/my-alb", ""},
+		{"ELB ", ""},
+		{"Interface for NAT Gateway nat-0123", ""},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.description, func(t *testing.T) {
+			if got := loadBalancerName(tt.description); got != tt.want {
+				t.Errorf("loadBalancerName(%q) = %q, want %q", tt.description, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAffectedSites(t *testing.T) {
+	cfg := config.Config{SiteMappings: []config.SiteMapping{
+		{LoadBalancer: "my-alb", Sites: []string{"app.example.com"}},
+		{LoadBalancer: "my-elb", Sites: []string{"legacy.example.com"}},
+		{DescriptionPrefix: "ELB net/internal-nlb/", Sites: []string{"internal.example.com"}},
+		{DescriptionPrefix: "ELB app/", Sites: []string{"all-albs.example.com"}},
+	}}
+
+	request := func(description string) string {
+		return `{"detail":{"eventName":"CreateNetworkInterface","requestParameters":{"description":"` + description + `"}}}`
+	}
+
+	tests := []struct {
+		name  string
+		event string
+		want  []string
+	}{
+		{"load balancer name", request("ELB app/my-alb/50dc6c495c0c9188"), []string{"app.example.com", "all-albs.example.com"}},
+		{"classic ELB", request("ELB my-elb"), []string{"legacy.example.com"}},
+		{"description prefix", request("ELB net/internal-nlb/1a2b"), []string{"internal.example.com"}},
+		{"only a prefix", request("ELB app/other-alb/1a2b"), []string{"all-albs.example.com"}},
+		{"no mapping", request("ELB net/other-nlb/1a2b"), nil},
+		{"description from the response", `{"detail":{"responseElements":{"networkInterface":{"description":"ELB my-elb"}}}}`, []string{"legacy.example.com"}},
+		{"no description", `{"detail":{"eventName":"DeleteNetworkInterface"}}`, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := affectedSites(cfg, parseEvent(t, tt.event)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("affectedSites() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
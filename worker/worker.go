@@ -1,141 +1,289 @@
 package worker
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"log"
-	"os"
-	"strings"
+	"sync"
+	"tailscale-route-tiller/apply"
+	"tailscale-route-tiller/awsutil"
 	"tailscale-route-tiller/config"
+	"tailscale-route-tiller/leader"
 	"tailscale-route-tiller/slack"
-	"tailscale-route-tiller/tailscale"
+	"tailscale-route-tiller/sources"
+	"tailscale-route-tiller/state"
 	"tailscale-route-tiller/utils"
 	"time"
 
-	"tailscale-route-tiller/cloudwatchevent"
-
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
 )
 
 var TestMode bool = false
 var Command string
 
-func parseCloudWatchEvent(message *sqs.Message) (*cloudwatchevent.CloudTrailEvent, error) {
-	var event cloudwatchevent.CloudTrailEvent
-	err := json.Unmarshal([]byte(*message.Body), &event)
-	if err != nil {
-		return nil, err
-	}
-	return &event, nil
+// updateLock serializes updates triggered by SQS messages and source changes
+var updateLock sync.Mutex
+
+// elector is set when several workers share the job, only the leader applies changes
+var elector *leader.Elector
+
+// consumer feeds batches of SQS messages into the pipeline
+type consumer struct {
+	svc      sqsiface.SQSAPI
+	config   config.Config
+	testMode bool
+	pipeline *Pipeline
 }
 
-func Run(testMode bool, config config.Config) {
+// Run consumes the SQS queue until the context is cancelled. A batch that is
+// being updated is finished first; one that is still waiting for DNS is
+// abandoned and its messages are made visible again.
+func Run(ctx context.Context, testMode bool, config config.Config) {
+
+	if err := checkSQSLimits(config.SQS); err != nil {
+		log.Fatal(err)
+	}
+
+	region := config.SQS.Region
+	if region == "" {
+		region = "us-west-2"
+	}
 
-	// Initialize a session in us-west-2 region that the SDK will use to load credentials
-	sess, err := session.NewSession(&aws.Config{
-		Region: aws.String("us-west-2")},
-	)
+	sess, err := awsutil.NewSession(awsutil.Options{
+		Region:   region,
+		Endpoint: config.SQS.Endpoint,
+		Profile:  config.SQS.Profile,
+		RoleARN:  config.SQS.RoleARN,
+	})
 
 	if err != nil {
 		log.Fatalf("failed to create session, %v", err)
 	}
 
-	// Create a SQS service client
-	svc := sqs.New(sess)
+	pipeline, err := NewPipeline(testMode, config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer pipeline.Close()
 
-	for {
-		// Receive a message from the SQS queue
-		result, err := svc.ReceiveMessage(&sqs.ReceiveMessageInput{
-			QueueUrl:            &config.SQS.QueueURL,
-			MaxNumberOfMessages: aws.Int64(1),
-			WaitTimeSeconds:     aws.Int64(20),
-		})
+	if err := pipeline.Start(ctx); err != nil {
+		log.Fatal(err)
+	}
 
-		if err != nil {
-			log.Fatalf("Unable to receive message from queue %q, %v.", config.SQS.QueueURL, err)
+	c := &consumer{
+		// Create a SQS service client
+		svc:      sqs.New(sess),
+		config:   config,
+		testMode: testMode,
+		pipeline: pipeline,
+	}
+	pipeline.Source = state.TriggerSQS
+
+	receiveInput := &sqs.ReceiveMessageInput{
+		QueueUrl:            &config.SQS.QueueURL,
+		MaxNumberOfMessages: aws.Int64(10),
+		WaitTimeSeconds:     aws.Int64(20),
+		AttributeNames:      []*string{aws.String(sqs.MessageSystemAttributeNameApproximateReceiveCount)},
+	}
+	if config.SQS.MaxMessages > 0 {
+		receiveInput.MaxNumberOfMessages = aws.Int64(config.SQS.MaxMessages)
+	}
+	if config.SQS.WaitTimeSeconds > 0 {
+		receiveInput.WaitTimeSeconds = aws.Int64(config.SQS.WaitTimeSeconds)
+	}
+	if config.SQS.VisibilityTimeout > 0 {
+		receiveInput.VisibilityTimeout = aws.Int64(config.SQS.VisibilityTimeout)
+	}
+
+	visibility := visibilityTimeout(c.svc, config)
+	backoff := time.Second
+
+	for ctx.Err() == nil {
+		// followers leave the queue to the leader
+		if !pipeline.IsLeader() {
+			sleep(ctx, 5*time.Second)
+			continue
 		}
 
-		if len(result.Messages) > 0 {
-			// Call a function to process the message here
-			// processMessage(result.Messages[0])
+		hb := newHeartbeat(c.svc, config, visibility)
 
-			message := result.Messages[0]
+		// Receive a batch of messages from the SQS queue
+		messages, err := receiveBatch(ctx, c.svc, config, receiveInput, hb)
 
-			if testMode {
-				log.Println("Test mode enabled. Message: ", *message.Body)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Unable to receive message from queue %q, retrying in %s: %v", config.SQS.QueueURL, backoff, err)
+			sleep(ctx, backoff)
+			if backoff < time.Minute {
+				backoff *= 2
 			}
+			// anything already received is still processed below
+		} else {
+			backoff = time.Second
+		}
 
-			// lets parse the message and hand off to the runUpdates function
-			event, err := parseCloudWatchEvent(message)
-			if err != nil {
-				log.Printf("Error parsing CloudWatch event: %v", err)
-				continue // Skip this message or handle the error as appropriate
-			}
+		if ctx.Err() != nil {
+			hb.release()
+			break
+		}
+
+		c.processBatch(ctx, messages, hb)
+		hb.stop()
+	}
+
+	log.Println("Worker stopped")
+}
+
+func (c *consumer) processBatch(ctx context.Context, messages []*sqs.Message, hb *heartbeat) {
+	if len(messages) == 0 {
+		return
+	}
 
-			// before running the udpate, we should wait for dns to settle
+	config := c.config
 
-			// lets wait for 2 minutes for DNS to settle
-			log.Println("Waiting for DNS to settle...")
-			time.Sleep(2 * time.Minute)
+	var processed []*sqs.Message
+	var events []Event
 
-			runUpdates(testMode, config, event)
+	for _, message := range messages {
+		if c.testMode {
+			log.Println("Test mode enabled. Message: ", *message.Body)
+		}
 
-			// Delete the message from the queue after processing
-			_, err = svc.DeleteMessage(&sqs.DeleteMessageInput{
-				QueueUrl:      &config.SQS.QueueURL,
-				ReceiptHandle: message.ReceiptHandle,
-			})
+		// messages that keep failing are not retried forever
+		if exhausted(config, message) {
+			hb.forget(message)
+			if err := deadLetter(c.svc, config, message, fmt.Sprintf("received %d times without being processed", receiveCount(message))); err != nil {
+				log.Printf("Failed to dead-letter message: %v", err)
+			}
+			continue
+		}
 
-			if err != nil {
-				log.Fatalf("Failed to delete message from queue, %v", err)
+		// lets unwrap and parse the message and hand off to the pipeline
+		parsed, err := ParseEvents([]byte(*message.Body), c.pipeline.Verifier)
+		if err != nil {
+			log.Printf("Error parsing CloudWatch event: %v", err)
+			hb.forget(message)
+			if err := deadLetter(c.svc, config, message, "unparseable event: "+err.Error()); err != nil {
+				log.Printf("Failed to dead-letter message: %v", err)
 			}
+			continue
 		}
+
+		processed = append(processed, message)
+		events = append(events, parsed...)
 	}
-}
 
-func runUpdates(testMode bool, config config.Config, event *cloudwatchevent.CloudTrailEvent) {
+	if len(processed) == 0 {
+		return
+	}
 
-	resolvedSubnets, _, err := utils.PerformDNSLookupsWithTTL(config.Sites, config.EnableIpv6)
+	err := c.pipeline.Handle(ctx, events)
+	if err == ErrAbandoned {
+		log.Println("Shutting down, returning unprocessed messages to the queue")
+		hb.release()
+		return
+	}
 	if err != nil {
-		log.Println("Error: ", err.Error())
-		slack.PostError(err)
+		// the messages become visible again and are retried until MaxReceiveCount
+		log.Println("Update failed, leaving messages on the queue: ", err.Error())
+		return
 	}
 
-	// Get the final list of subnets to approve
-	resolvedSubnets = append(resolvedSubnets, config.Subnets...)
-	resolvedSubnets = utils.Unique(resolvedSubnets)
+	// Delete the messages from the queue after processing
+	hb.forget(processed...)
+	err = deleteMessages(c.svc, config, processed)
 
-	log.Println("Resolved subnets: ", resolvedSubnets)
+	if err != nil {
+		log.Printf("Failed to delete messages from queue, they will be processed again: %v", err)
+	}
+}
+
+// checkSQSLimits rejects receive settings that SQS would refuse on every call
+func checkSQSLimits(cfg config.SQS) error {
+	if cfg.MaxMessages < 0 || cfg.MaxMessages > 10 {
+		return fmt.Errorf("SQS.MaxMessages must be at most 10, got %d", cfg.MaxMessages)
+	}
+	if cfg.WaitTimeSeconds < 0 || cfg.WaitTimeSeconds > 20 {
+		return fmt.Errorf("SQS.WaitTimeSeconds must be at most 20, got %d", cfg.WaitTimeSeconds)
+	}
+	return nil
+}
+
+// runUpdates advertises and approves the full route set. Only the sites in
+// refresh are resolved again, all of them when refresh is nil.
+func runUpdates(testMode bool, config config.Config, descriptions []string, note string, refresh []string, trigger state.Trigger) error {
+	updateLock.Lock()
+	defer updateLock.Unlock()
 
-	// format subnets as a string for the tailscale command
-	subnetsString := strings.Join(resolvedSubnets, ",")
+	// leadership may have moved on while the batch was settling
+	if elector != nil && !elector.IsLeader() {
+		log.Println(apply.ErrNotLeader.Error())
+		return apply.ErrNotLeader
+	}
 
-	// combine the command with the subnets
-	fullCommand := fmt.Sprintf(config.TailscaleCommand, subnetsString)
+	resolvedSubnets, err := desiredRoutes(config, refresh)
+	if err != nil {
+		log.Println("Error: ", err.Error())
+		slack.PostError(err)
+		return err
+	}
 
+	// test mode changes nothing, so there is nothing to tell Slack about
 	if testMode {
-		log.Println("Test mode enabled. Command: ", fullCommand)
+		log.Println("Test mode enabled, not posting to Slack.")
+	} else if len(descriptions) == 1 && note == "" {
+		slack.PostRouteUpdateSQS(descriptions[0], config.TailscaleclientId)
 	} else {
-		// run the command
-		output := utils.RunShellCommand(fullCommand, testMode)
+		slack.PostBatchSummary(descriptions, note, config.TailscaleclientId)
+	}
+
+	return applyRoutes(testMode, config, resolvedSubnets, trigger)
+}
 
-		// log the output
-		log.Println(string(output))
+// desiredRoutes combines the resolved sites, static subnets and route sources
+func desiredRoutes(config config.Config, refresh []string) ([]string, error) {
+	resolvedSubnets, err := resolveSites(config, refresh)
+	if err != nil {
+		return nil, err
 	}
 
-	networkDescription := event.Detail.RequestParameters.Description
-	slack.PostRouteUpdateSQS(networkDescription, config.TailscaleclientId)
+	// Get the final list of subnets to approve
+	resolvedSubnets = append(resolvedSubnets, config.Subnets...)
+
+	sourcedRoutes, err := sources.Collect(config)
+	if err != nil {
+		return nil, err
+	}
+	resolvedSubnets = append(resolvedSubnets, sources.Prefixes(sourcedRoutes)...)
+	resolvedSubnets = utils.CanonicalPrefixes(resolvedSubnets)
 
+	log.Println("Resolved subnets: ", resolvedSubnets)
+	return resolvedSubnets, nil
+}
+
+// applyRoutes advertises and approves the routes, rolling back on failure
+func applyRoutes(testMode bool, config config.Config, resolvedSubnets []string, trigger state.Trigger) error {
 	if testMode {
-		log.Println("Test mode enabled, not updating tailscale routes.")
-	} else {
-		err = tailscale.SetTailscaleApprovedSubnets(resolvedSubnets)
+		args, err := config.TailscaleCommand.Expand(resolvedSubnets)
 		if err != nil {
-			log.Println("Error: ", err.Error())
+			return err
+		}
+		log.Printf("Test mode enabled. Command: %q", args)
+		log.Println("Test mode enabled, not updating tailscale routes.")
+		return nil
+	}
+
+	// shutting down must not interrupt an apply halfway
+	err := apply.Routes(context.Background(), config, resolvedSubnets, trigger)
+	if err != nil {
+		log.Println("Error: ", err.Error())
+		// losing the lease is already posted as a leadership change
+		if !errors.Is(err, apply.ErrNotLeader) {
 			slack.PostError(err)
-			os.Exit(1)
 		}
+		return err
 	}
+	return nil
 }
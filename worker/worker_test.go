@@ -0,0 +1,29 @@
+package worker
+
+import (
+	"tailscale-route-tiller/config"
+	"testing"
+)
+
+func TestCheckSQSLimits(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.SQS
+		ok   bool
+	}{
+		{"defaults", config.SQS{}, true},
+		{"at the limits", config.SQS{MaxMessages: 10, WaitTimeSeconds: 20}, true},
+		{"too many messages", config.SQS{MaxMessages: 11}, false},
+		{"negative messages", config.SQS{MaxMessages: -1}, false},
+		{"wait too long", config.SQS{WaitTimeSeconds: 21}, false},
+		{"negative wait", config.SQS{WaitTimeSeconds: -1}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkSQSLimits(tt.cfg); (err == nil) != tt.ok {
+				t.Errorf("checkSQSLimits() = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}